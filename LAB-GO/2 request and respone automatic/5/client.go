@@ -1,39 +1,132 @@
 package main
 
 import (
+    "bufio"
+    "errors"
     "fmt"
+    "io"
     "net"
     "os"
 	"time"
     "path/filepath"
+    "strconv"
+    "sort"
     "strings"
+    "crypto/rand"
+    "crypto/sha256"
+    "crypto/tls"
+    "crypto/x509"
+    "encoding/hex"
     "encoding/json"
+    "encoding/pem"
+
+    "labgo/protocol"
+)
+
+const (
+    agentVersion = "5.2"
+
+    // Beacons come every couple of seconds, long enough to hear them all
+    discoveryTimeout = 5 * time.Second
+
+    maxSendAttempts = 3
 )
 
-type FileInfo struct {
+// Capabilities announced in Hello; the server answers with the subset it
+// also supports.
+var clientCapabilities = []string{protocol.CapChunkedTransfer, protocol.CapServerPolicy, protocol.CapFileAck, protocol.CapResume, protocol.CapManifest, protocol.CapDeltaSync, protocol.CapFileEvents, protocol.CapHeartbeat, protocol.CapDistribution}
+
+// Used with --ext when the server does not push its own extension list.
+var defaultExtensions = []string{".cpp", ".py", ".c"}
+
+// Already compressed formats are sent as they are.
+var compressedExtensions = []string{
+    ".zip", ".gz", ".tgz", ".bz2", ".xz", ".7z", ".rar", ".jar",
+    ".png", ".jpg", ".jpeg", ".gif", ".webp",
+    ".mp3", ".mp4", ".mkv", ".avi",
+    ".pdf", ".docx", ".xlsx", ".pptx",
+}
+
+// candidate is a file or folder picked by the collection policy.
+type candidate struct {
+    Path         string // empty for folders
     RelativePath string
-    Content      []byte
-    ClientIP     string
-    Username     string
+    Info         os.FileInfo
+}
+
+// hashCacheEntry remembers a file digest across sessions; the reconnect
+// loop would otherwise hash every file again every few seconds.
+type hashCacheEntry struct {
+    Size    int64
+    ModTime time.Time
+    SHA256  string
 }
 
+var hashCache = make(map[string]hashCacheEntry)
 
+// Below this size compression does not pay for its own header.
+const minCompressSize = 256
+
+// Session is an established connection to the server.
+type Session struct {
+    Conn     net.Conn
+    Reader   *bufio.Reader
+    Writer   *bufio.Writer
+    Hostname string
+    Identity *Identity
+    Welcome  protocol.Welcome
+    Manifest []protocol.ManifestEntry // everything this session meant to send
+    Previous map[string]bool // paths the last finished session sent, true for folders
+
+    Heartbeat *protocol.Heartbeat // nil unless the server supports heartbeats
+
+    FilesSent int   // counted against Welcome.Limits
+    BytesSent int64
+}
 
 const (
-    defaultServerIP = "192.168.2.50:8080"
+    CERT_FILE = "lab_cert.pem"
+    IDENTITY_FILE = "client_identity.json"
 )
 
+// Identity is this machine's enrollment, stored in IDENTITY_FILE. The
+// MachineID is generated on first run; Key is issued by the server when
+// the machine enrolls with a pairing code.
+type Identity struct {
+    MachineID string
+    Key       string
+}
+
+// Config holds the command line. The match flags are local overrides of
+// the server policy and are only honoured when the server allows it.
 type Config struct {
-    ServerIP    string
+    ServerIP    string // empty: discover the server on the LAN
+    Session     string // session name to pick among discovered servers
     SearchPath  string
     FilterExts  bool
     MatchFiles  bool
     MatchFolders bool
+    MaxDepth    int
+    Pin         string
+    CertFile    string
+    NoTLS       bool
+    IdentityFile string
+    EnrollCode  string
+    NoCompress  bool
+    Target      string // folder for the server's starter files, empty for the one it names
+
+    DialTimeout time.Duration
+    Timeout     time.Duration // longest wait for the server while talking to it
+}
+
+func (c Config) hasOverrides() bool {
+    return c.FilterExts || c.MatchFiles || c.MatchFolders || c.MaxDepth > 0
 }
 
 func parseArgs() Config {
     config := Config{
-        ServerIP: defaultServerIP,
+        DialTimeout: 10 * time.Second,
+        Timeout:     2 * time.Minute,
     }
 
     for i := 1; i < len(os.Args); i++ {
@@ -48,59 +141,198 @@ func parseArgs() Config {
             config.MatchFiles = true
         case arg == "--folder":
             config.MatchFolders = true
+        case arg == "--depth":
+            value := flagValue(&i)
+            depth, err := strconv.Atoi(value)
+            if err != nil || depth < 1 {
+                fmt.Printf("Error: invalid --depth %q\n", value)
+                os.Exit(1)
+            }
+            config.MaxDepth = depth
+        case arg == "--pin":
+            config.Pin = normalizeFingerprint(flagValue(&i))
+        case arg == "--cert":
+            config.CertFile = flagValue(&i)
+        case arg == "--no-tls":
+            config.NoTLS = true
+        case arg == "--identity":
+            config.IdentityFile = flagValue(&i)
+        case arg == "--enroll":
+            config.EnrollCode = flagValue(&i)
+        case arg == "--no-compress":
+            config.NoCompress = true
+        case arg == "--session":
+            config.Session = flagValue(&i)
+        case arg == "--target":
+            config.Target = flagValue(&i)
+        case arg == "--dial-timeout":
+            config.DialTimeout = flagDuration(&i)
+        case arg == "--timeout":
+            config.Timeout = flagDuration(&i)
         case strings.HasPrefix(arg, "--"):
             fmt.Printf("Unknown flag: %s\n", arg)
             os.Exit(1)
-        case config.ServerIP == defaultServerIP:
+        case config.ServerIP == "" && config.SearchPath == "" && net.ParseIP(arg) != nil:
             config.ServerIP = arg + ":8080"
         default:
             config.SearchPath = arg
         }
     }
 
-    if !config.MatchFiles && !config.MatchFolders {
-        fmt.Println("Error: Must specify at least one of --file or --folder flags")
-        printHelp()
+    return config
+}
+
+// flagValue returns the value following the flag at os.Args[*i] and moves
+// i past it.
+func flagValue(i *int) string {
+    if *i+1 >= len(os.Args) {
+        fmt.Printf("Error: %s needs a value\n", os.Args[*i])
         os.Exit(1)
     }
-
-    return config
+    *i++
+    return os.Args[*i]
 }
 
+// resolvePolicy combines the policy pushed by the server with the local
+// flags. Servers without the server-policy feature get the old behaviour
+// where the flags decide everything.
+func resolvePolicy(config Config, welcome protocol.Welcome) (protocol.Policy, error) {
+    if !protocol.HasFeature(welcome.Features, protocol.CapServerPolicy) {
+        if !config.MatchFiles && !config.MatchFolders {
+            return protocol.Policy{}, fmt.Errorf("server does not push a policy; specify --file and/or --folder")
+        }
+        policy := protocol.Policy{
+            MatchFiles:   config.MatchFiles,
+            MatchFolders: config.MatchFolders,
+            MaxDepth:     5,
+        }
+        if config.FilterExts {
+            policy.Extensions = defaultExtensions
+        }
+        if config.MaxDepth > 0 {
+            policy.MaxDepth = config.MaxDepth
+        }
+        return policy, nil
+    }
 
+    policy := welcome.Policy
+    if config.hasOverrides() {
+        if !policy.AllowOverride {
+            fmt.Println("Server policy does not allow local overrides, ignoring --file/--folder/--ext/--depth")
+            return policy, nil
+        }
+        if config.MatchFiles || config.MatchFolders {
+            policy.MatchFiles = config.MatchFiles
+            policy.MatchFolders = config.MatchFolders
+        }
+        if config.FilterExts && len(policy.Extensions) == 0 {
+            policy.Extensions = defaultExtensions
+        }
+        if config.MaxDepth > 0 {
+            policy.MaxDepth = config.MaxDepth
+        }
+    }
+    return policy, nil
+}
+
+func flagDuration(i *int) time.Duration {
+    flag := os.Args[*i]
+    value := flagValue(i)
+    d, err := time.ParseDuration(value)
+    if err != nil || d < 0 {
+        fmt.Printf("Error: invalid %s %q (e.g. 30s, 5m)\n", flag, value)
+        os.Exit(1)
+    }
+    return d
+}
 func printHelp() {
     fmt.Println(`Usage: ./client [SERVER_IP] [SEARCH_PATH] [FLAGS]
     
 Arguments:
-    SERVER_IP    Optional. IP address of the server (default: 192.168.2.50)
+    SERVER_IP    Optional. IP address of the server (default: found through its LAN beacon)
     SEARCH_PATH  Optional. Path to search for files (default: Documents folder)
 
-Flags:
+Flags (override the server policy, only if the server allows it):
     --file      Enable file pattern matching
     --folder    Enable folder pattern matching
     --ext       Only process .cpp, .py, and .c files (requires --file)
-    --help, -h  Show this help message
+    --depth N   Maximum folder depth to search (server default: 5)
+
+Transport:
+    --session NAME    With several servers on the LAN, use the one announcing NAME
+    --pin SHA256  Fingerprint of the lab certificate (printed by ./server gen-cert)
+    --cert FILE   Lab certificate to pin (default: lab_cert.pem next to the client)
+    --no-tls      Connect without TLS (only for servers started with --no-tls)
+    --no-compress Send file contents uncompressed
+    --dial-timeout D  Give up a connection attempt after D (default: 10s)
+    --timeout D       Drop the connection when the server is silent for D (default: 2m, 0 = never)
+
+Exam start:
+    --target DIR      Put the server's starter files in DIR instead of the folder
+                      it names inside SEARCH_PATH. Existing files are never overwritten
+
+Enrollment:
+    --enroll CODE     Enroll this PC with the pairing code shown by ./server pair
+    --identity FILE   Where this PC's key is stored (default: client_identity.json next to the client)
+    --help, -h    Show this help message
 
 Examples:
     ./client 192.168.1.2 --file
     ./client 192.168.1.2 --folder
     ./client 192.168.1.2 --file --folder
     ./client 192.168.1.2 --file --ext
-    ./client --file --folder "D:\Data\Projects"`)
+    ./client --file --folder "D:\Data\Projects"
+    ./client 192.168.1.2 --enroll 1234-5678
+    ./client --session lab-b --file`)
 }
 
 func main() {
     config := parseArgs()
 
+    var tlsConfig *tls.Config
+    if !config.NoTLS {
+        pin, err := loadPin(config)
+        if err != nil {
+            fmt.Printf("Error: %v\n", err)
+            return
+        }
+        tlsConfig = pinnedTLSConfig(pin)
+        fmt.Printf("Pinned server certificate: %s\n", pin)
+    }
+
     hostname, err := os.Hostname()
     if err != nil {
         fmt.Printf("Error getting hostname: %v\n", err)
         return
     }
 
+    identity, identityFile, err := loadIdentity(config.IdentityFile)
+    if err != nil {
+        fmt.Printf("Error loading identity: %v\n", err)
+        return
+    }
+    fmt.Printf("Machine ID: %s\n", identity.MachineID)
+    pairingCode := config.EnrollCode
+
+    // Lets the server continue files cut off by a dropped connection
+    lastSessionID := ""
+    // What the last finished session sent, to notice deleted files
+    previousFiles := make(map[string]bool)
+
     for {
         fmt.Println("\nWaiting for server connection...")
-        conn, err := connectWithRetry(config.ServerIP)
+        serverIP := config.ServerIP
+        if serverIP == "" {
+            serverIP, err = discoverServer(config.Session, discoveryTimeout)
+            if err != nil {
+                fmt.Printf("Server discovery failed: %v\n", err)
+                time.Sleep(5 * time.Second)
+                continue
+            }
+            fmt.Printf("Found server at %s\n", serverIP)
+        }
+
+        conn, err := connectWithRetry(serverIP, tlsConfig, config.DialTimeout)
         if err != nil {
             fmt.Printf("Failed to connect: %v\n", err)
             time.Sleep(5 * time.Second)
@@ -110,14 +342,36 @@ func main() {
         func() {
             defer conn.Close()
             
-            patterns, err := getPathPatternsFromServer(conn)
+            dc := &protocol.DeadlineConn{Conn: conn, ReadTimeout: config.Timeout, WriteTimeout: config.Timeout}
+            session, err := startSession(dc, hostname, identity, pairingCode, lastSessionID, !config.NoCompress)
             if err != nil {
-                fmt.Printf("Error getting patterns from server: %v\n", err)
+                fmt.Printf("Error starting session with server: %v\n", err)
                 return
             }
+            lastSessionID = session.Welcome.SessionID
+            session.Previous = previousFiles
 
+            if session.Welcome.EnrolledKey != "" {
+                identity.Key = session.Welcome.EnrolledKey
+                if err := saveIdentity(identityFile, identity); err != nil {
+                    fmt.Printf("Error saving enrollment key: %v\n", err)
+                    return
+                }
+                pairingCode = ""
+                fmt.Printf("Enrolled with server, key stored in %s\n", identityFile)
+            }
+
+            patterns := session.Welcome.Patterns
             fmt.Printf("Processing patterns: %v\n", patterns)
 
+            policy, err := resolvePolicy(config, session.Welcome)
+            if err != nil {
+                fmt.Printf("Error: %v\n", err)
+                return
+            }
+            fmt.Printf("Collection policy: files=%v folders=%v extensions=%v depth=%d\n",
+                policy.MatchFiles, policy.MatchFolders, policy.Extensions, policy.MaxDepth)
+
             searchPath := config.SearchPath
             if searchPath == "" {
                 homeDir, err := os.UserHomeDir()
@@ -128,9 +382,32 @@ func main() {
                 searchPath = filepath.Join(homeDir, "Documents")
             }
 
-            err = searchAndSendFiles(searchPath, patterns, conn, hostname)
+            // Missing starter files are reported, but the student's own
+            // files are still collected
+            if dist := session.Welcome.Distribution; dist != nil {
+                if err := fetchStarterFiles(session, config, *dist, searchPath); err != nil {
+                    fmt.Printf("Error fetching starter files: %v\n", err)
+                    if err := reportError(session, dist.Target, fmt.Errorf("starter files not fetched: %v", err)); err != nil {
+                        fmt.Printf("Error: %v\n", err)
+                        return
+                    }
+                }
+            }
+
+            err = searchAndSendFiles(searchPath, patterns, policy, session)
             if err != nil {
                 fmt.Printf("Error during file operations: %v\n", err)
+                return
+            }
+            previousFiles = make(map[string]bool)
+            for _, entry := range session.Manifest {
+                previousFiles[entry.RelativePath] = entry.IsDir
+            }
+
+            if protocol.HasFeature(session.Welcome.Features, protocol.CapManifest) {
+                if err := finishSession(session); err != nil {
+                    fmt.Printf("Error finishing session: %v\n", err)
+                }
             }
         }()
 
@@ -139,58 +416,525 @@ func main() {
     }
 }
 
+// loadIdentity reads this machine's identity, creating a new machine ID
+// on first run. It returns the path the identity is stored at.
+func loadIdentity(path string) (*Identity, string, error) {
+    if path == "" {
+        path = IDENTITY_FILE
+        if exe, err := os.Executable(); err == nil {
+            path = filepath.Join(filepath.Dir(exe), IDENTITY_FILE)
+        }
+    }
 
+    identity := &Identity{}
+    data, err := os.ReadFile(path)
+    if err == nil {
+        if err := json.Unmarshal(data, identity); err != nil {
+            return nil, path, fmt.Errorf("%s: %v", path, err)
+        }
+    } else if !os.IsNotExist(err) {
+        return nil, path, err
+    }
 
+    if identity.MachineID == "" {
+        id := make([]byte, 16)
+        if _, err := rand.Read(id); err != nil {
+            return nil, path, err
+        }
+        identity.MachineID = hex.EncodeToString(id)
+        if err := saveIdentity(path, identity); err != nil {
+            return nil, path, err
+        }
+    }
+    return identity, path, nil
+}
 
-func isValidExtension(path string) bool {
-    ext := strings.ToLower(filepath.Ext(path))
-    return ext == ".cpp" || ext == ".py" || ext == ".c"
+func saveIdentity(path string, identity *Identity) error {
+    data, err := json.MarshalIndent(identity, "", "  ")
+    if err != nil {
+        return err
+    }
+    return os.WriteFile(path, data, 0600)
 }
 
+func answerChallenge(session *Session, hello protocol.Hello, payload []byte) error {
+    if session.Identity.Key == "" {
+        return errors.New("this machine is not enrolled; run once with --enroll CODE (see ./server pair)")
+    }
+    key, err := hex.DecodeString(session.Identity.Key)
+    if err != nil {
+        return fmt.Errorf("corrupt key in identity file: %v", err)
+    }
+    var challenge protocol.Challenge
+    if err := json.Unmarshal(payload, &challenge); err != nil {
+        return fmt.Errorf("invalid challenge: %v", err)
+    }
 
-func containsPattern(path string, patterns []string) bool {
-    pathLower := strings.ToLower(path)
-    for _, pattern := range patterns {
-        if strings.Contains(pathLower, strings.ToLower(pattern)) {
-            return true
+    response := protocol.AuthResponse{MAC: protocol.AuthMAC(key, challenge.Nonce, hello)}
+    if err := protocol.WriteJSONFrame(session.Writer, protocol.FrameAuth, response); err != nil {
+        return fmt.Errorf("error sending auth response: %v", err)
+    }
+    return session.Writer.Flush()
+}
+
+// startSession performs the hello/welcome exchange and returns the session
+// negotiated with the server.
+func startSession(conn net.Conn, hostname string, identity *Identity, pairingCode string, resumeSessionID string, compress bool) (*Session, error) {
+    session := &Session{
+        Conn:     conn,
+        Reader:   bufio.NewReader(conn),
+        Writer:   bufio.NewWriter(conn),
+        Hostname: hostname,
+        Identity: identity,
+    }
+
+    hello := protocol.Hello{
+        ProtocolVersion: protocol.Version,
+        MachineID:       identity.MachineID,
+        PairingCode:     pairingCode,
+        Hostname:        hostname,
+        ClientIP:        getLocalIP(),
+        AgentVersion:    agentVersion,
+        Capabilities:    clientCapabilities,
+        ResumeSessionID: resumeSessionID,
+    }
+    if compress {
+        hello.Codecs = protocol.CodecPreference
+    }
+    if _, err := session.Writer.WriteString(protocol.Magic); err != nil {
+        return nil, err
+    }
+    if err := protocol.WriteJSONFrame(session.Writer, protocol.FrameHello, hello); err != nil {
+        return nil, fmt.Errorf("error sending hello: %v", err)
+    }
+    if err := session.Writer.Flush(); err != nil {
+        return nil, fmt.Errorf("error sending hello: %v", err)
+    }
+
+    // Servers from before the handshake send a bare JSON pattern list
+    if first, err := session.Reader.Peek(1); err == nil && first[0] == '[' {
+        return nil, errors.New("server speaks the old pattern-list protocol (no handshake); upgrade the server")
+    }
+
+    frameType, payload, err := protocol.ReadControlFrame(session.Reader)
+    if err != nil {
+        return nil, fmt.Errorf("error receiving welcome: %v", err)
+    }
+    if frameType == protocol.FrameChallenge {
+        if err := answerChallenge(session, hello, payload); err != nil {
+            return nil, err
+        }
+        frameType, payload, err = protocol.ReadControlFrame(session.Reader)
+        if err != nil {
+            return nil, fmt.Errorf("error receiving welcome: %v", err)
         }
     }
-    return false
+    if frameType != protocol.FrameWelcome {
+        return nil, fmt.Errorf("unexpected frame %q, want welcome", frameType)
+    }
+    if err := json.Unmarshal(payload, &session.Welcome); err != nil {
+        return nil, fmt.Errorf("invalid welcome: %v", err)
+    }
+    welcome := session.Welcome
+    if welcome.Error != "" {
+        return nil, fmt.Errorf("server refused session: %s", welcome.Error)
+    }
+    if welcome.ProtocolVersion != protocol.Version {
+        return nil, fmt.Errorf("protocol version mismatch: client speaks %d, server speaks %d",
+            protocol.Version, welcome.ProtocolVersion)
+    }
+
+    fmt.Printf("Session %s with server %s, features %v\n", welcome.SessionID, welcome.ServerVersion, welcome.Features)
+    if welcome.Codec != "" {
+        if _, ok := protocol.Codecs[welcome.Codec]; !ok {
+            return nil, fmt.Errorf("server picked unknown codec %q", welcome.Codec)
+        }
+        fmt.Printf("Compressing transfers with %s\n", welcome.Codec)
+    }
+    if welcome.Resumed {
+        fmt.Println("Resuming previous session")
+    }
+    if protocol.HasFeature(welcome.Features, protocol.CapHeartbeat) {
+        session.Heartbeat = &protocol.Heartbeat{W: session.Writer, Last: time.Now()}
+    }
+    fmt.Printf("Received patterns from server: %v\n", welcome.Patterns)
+    return session, nil
 }
 
-func searchAndSendFiles(rootPath string, patterns []string, conn net.Conn, hostname string) error {
-    config := parseArgs()
+// sendFile streams one file (or a bare directory entry when path is empty)
+// as header, data frames and trailer. When resume points into the file and
+// the server's prefix still matches, only the rest of the file is sent.
+func sendFile(w *bufio.Writer, header protocol.FileHeader, path string, resume protocol.ResumeOffset) (protocol.ManifestEntry, error) {
+    entry := protocol.ManifestEntry{RelativePath: header.RelativePath, IsDir: header.IsDir}
+    h := sha256.New()
+    var f *os.File
+    if !header.IsDir {
+        var err error
+        f, err = os.Open(path)
+        if err != nil {
+            return entry, err
+        }
+        defer f.Close()
+
+        info, err := f.Stat()
+        if err != nil {
+            return entry, err
+        }
+        header.Size = info.Size()
+        header.ModTime = info.ModTime()
+        header.Mode = info.Mode().Perm()
+        entry.Size = header.Size
+
+        if resume.Offset > 0 && resume.Offset <= header.Size {
+            if _, err := io.CopyN(h, f, resume.Offset); err != nil {
+                return entry, err
+            }
+            if hex.EncodeToString(h.Sum(nil)) == resume.PrefixSHA256 {
+                header.Offset = resume.Offset
+            } else {
+                // File changed since the interrupted transfer, start over
+                if _, err := f.Seek(0, io.SeekStart); err != nil {
+                    return entry, err
+                }
+                h.Reset()
+            }
+        }
+    }
+
+    if err := protocol.WriteJSONFrame(w, protocol.FrameFileHeader, header); err != nil {
+        return entry, fmt.Errorf("error sending file header: %v", err)
+    }
+
+    cw := &protocol.ChunkWriter{W: w}
+    if f != nil {
+        var dst io.Writer = cw
+        var zw io.WriteCloser
+        if header.Encoding != "" {
+            zw = protocol.Codecs[header.Encoding].NewWriter(cw)
+            dst = zw
+        }
+        if _, err := io.Copy(dst, io.TeeReader(f, h)); err != nil {
+            return entry, fmt.Errorf("error sending file data: %v", err)
+        }
+        if zw != nil {
+            if err := zw.Close(); err != nil {
+                return entry, fmt.Errorf("error sending file data: %v", err)
+            }
+        }
+    }
+
+    trailer := protocol.FileTrailer{Size: cw.Written}
+    if !header.IsDir {
+        trailer.SHA256 = hex.EncodeToString(h.Sum(nil))
+        entry.SHA256 = trailer.SHA256
+    }
+    if err := protocol.WriteJSONFrame(w, protocol.FrameFileTrailer, trailer); err != nil {
+        return entry, fmt.Errorf("error sending file trailer: %v", err)
+    }
+    return entry, w.Flush()
+}
+
+// deliverFile sends one entry and, when the server acknowledges files,
+// waits for the verdict and resends until it is confirmed or
+// maxSendAttempts is reached.
+func deliverFile(session *Session, header protocol.FileHeader, path string) error {
+    var resume protocol.ResumeOffset
+    if session.Welcome.Resumed && protocol.HasFeature(session.Welcome.Features, protocol.CapResume) && !header.IsDir {
+        var err error
+        resume, err = queryResumeOffset(session, header.RelativePath, path)
+        if err != nil {
+            return err
+        }
+    }
+
+    if !header.IsDir && shouldCompress(path) {
+        header.Encoding = session.Welcome.Codec
+    }
+
+    if !protocol.HasFeature(session.Welcome.Features, protocol.CapFileAck) {
+        entry, err := sendFile(session.Writer, header, path, resume)
+        if err != nil {
+            return err
+        }
+        session.Manifest = append(session.Manifest, entry)
+        return nil
+    }
+
+    for attempt := 1; attempt <= maxSendAttempts; attempt++ {
+        entry, err := sendFile(session.Writer, header, path, resume)
+        if err != nil {
+            return err
+        }
+        // Listed whether or not the server accepts it, so a file given up
+        // on shows as missing in the submission status
+        if attempt == 1 {
+            session.Manifest = append(session.Manifest, entry)
+        } else {
+            session.Manifest[len(session.Manifest)-1] = entry
+        }
+        // Retries always start from the beginning
+        resume = protocol.ResumeOffset{}
+
+        var ack protocol.FileAck
+        if err := protocol.ReadJSONFrame(session.Reader, protocol.FrameFileAck, &ack); err != nil {
+            return fmt.Errorf("error receiving ack for %s: %v", header.RelativePath, err)
+        }
+        if ack.OK {
+            if ack.SHA256 != "" {
+                fmt.Printf("Server confirmed %s (sha256 %s)\n", header.RelativePath, ack.SHA256)
+            }
+            return nil
+        }
+        fmt.Printf("Server rejected %s (attempt %d/%d): %s\n", header.RelativePath, attempt, maxSendAttempts, ack.Error)
+    }
+
+    fmt.Printf("Giving up on %s: not confirmed after %d attempts\n", header.RelativePath, maxSendAttempts)
+    return nil
+}
+
+// finishSession sends the manifest of everything the session meant to send
+// and reports the server's verdict on the submission.
+func finishSession(session *Session) error {
+    for _, entry := range session.Manifest {
+        if err := protocol.WriteJSONFrame(session.Writer, protocol.FrameManifest, entry); err != nil {
+            return fmt.Errorf("error sending manifest: %v", err)
+        }
+    }
+    if err := protocol.WriteJSONFrame(session.Writer, protocol.FrameManifestEnd, protocol.ManifestEnd{Files: len(session.Manifest)}); err != nil {
+        return fmt.Errorf("error sending manifest: %v", err)
+    }
+    if err := session.Writer.Flush(); err != nil {
+        return fmt.Errorf("error sending manifest: %v", err)
+    }
+
+    var status protocol.SubmissionStatus
+    if err := protocol.ReadJSONFrame(session.Reader, protocol.FrameSubmission, &status); err != nil {
+        return fmt.Errorf("error receiving submission status: %v", err)
+    }
+    fmt.Printf("Submission %s: %d files\n", status.Status, status.Files)
+    for _, path := range status.Missing {
+        fmt.Printf("  missing on server: %s\n", path)
+    }
+    for _, path := range status.Corrupt {
+        fmt.Printf("  corrupt on server: %s\n", path)
+    }
+    return nil
+}
+
+// fetchStarterFiles puts the server's starter files into --target, or else
+// the folder the server names under the search path.
+func fetchStarterFiles(session *Session, config Config, dist protocol.Distribution, searchPath string) error {
+    target := config.Target
+    if target == "" {
+        if err := (protocol.FileHeader{RelativePath: dist.Target}).Validate(); err != nil {
+            return fmt.Errorf("server names a bad starter folder: %v", err)
+        }
+        target = filepath.Join(searchPath, filepath.FromSlash(dist.Target))
+    }
+    return fetchDistribution(session, dist, target)
+}
+
+// fetchDistribution puts the server's starter files into target. Files
+// the student already has are never overwritten: a copy with the same hash
+// is left alone and a different one is kept as the student's work.
+func fetchDistribution(session *Session, dist protocol.Distribution, target string) error {
+    var wanted protocol.WantedFiles
+    present, kept := 0, 0
+    for i, file := range dist.Files {
+        if err := (protocol.FileHeader{RelativePath: file.RelativePath}).Validate(); err != nil {
+            return fmt.Errorf("bad starter file: %v", err)
+        }
+        dest := filepath.Join(target, filepath.FromSlash(file.RelativePath))
+        if file.IsDir {
+            if err := os.MkdirAll(dest, 0755); err != nil {
+                return err
+            }
+            continue
+        }
+
+        info, err := os.Stat(dest)
+        if os.IsNotExist(err) {
+            wanted.Indexes = append(wanted.Indexes, i)
+            continue
+        }
+        if err != nil {
+            return err
+        }
+        if !info.IsDir() {
+            if sum, err := fileHash(dest, info); err == nil && sum == file.SHA256 {
+                present++
+                continue
+            }
+        }
+        kept++
+    }
+
+    downloaded := 0
+    if len(wanted.Indexes) > 0 {
+        if err := protocol.WriteJSONFrame(session.Writer, protocol.FrameDistRequest, wanted); err != nil {
+            return fmt.Errorf("error requesting starter files: %v", err)
+        }
+        if err := session.Writer.Flush(); err != nil {
+            return fmt.Errorf("error requesting starter files: %v", err)
+        }
+        for _, i := range wanted.Indexes {
+            file := dist.Files[i]
+            ok, err := receiveDistFile(session, file, filepath.Join(target, filepath.FromSlash(file.RelativePath)))
+            if err != nil {
+                return err
+            }
+            if ok {
+                downloaded++
+            }
+        }
+    }
+    fmt.Printf("Starter files in %s: %d downloaded, %d already there, %d changed by the student and kept\n",
+        target, downloaded, present, kept)
+    return nil
+}
+
+// receiveDistFile saves one starter file sent by the server after checking
+// its hash against the one announced in Welcome. Problems with the file
+// itself are printed and skipped; an error means the stream is broken.
+func receiveDistFile(session *Session, file protocol.DistFile, dest string) (bool, error) {
+    var header protocol.FileHeader
+    if err := protocol.ReadJSONFrame(session.Reader, protocol.FrameFileHeader, &header); err != nil {
+        return false, fmt.Errorf("error receiving starter file: %v", err)
+    }
+    if header.RelativePath != file.RelativePath {
+        return false, fmt.Errorf("server sent %s, expected %s", header.RelativePath, file.RelativePath)
+    }
+
+    data := &protocol.ChunkReader{R: session.Reader}
+    part := dest + ".part"
+    h := sha256.New()
+    saveErr := os.MkdirAll(filepath.Dir(dest), 0755)
+    if saveErr == nil {
+        var f *os.File
+        if f, saveErr = os.Create(part); saveErr == nil {
+            _, saveErr = io.Copy(io.MultiWriter(f, h), data)
+            if err := f.Close(); saveErr == nil {
+                saveErr = err
+            }
+        }
+    }
+    // Drain whatever was not written so the next header lines up
+    if _, err := io.Copy(io.Discard, data); err != nil {
+        os.Remove(part)
+        return false, fmt.Errorf("error receiving starter file: %v", err)
+    }
+
+    sum := hex.EncodeToString(h.Sum(nil))
+    if saveErr == nil && data.Trailer.SHA256 == "" {
+        saveErr = errors.New("the server could not read it")
+    } else if saveErr == nil && (sum != data.Trailer.SHA256 || sum != file.SHA256) {
+        saveErr = fmt.Errorf("sha256 mismatch: announced %s, received %s", file.SHA256, sum)
+    }
+    if saveErr != nil {
+        os.Remove(part)
+        fmt.Printf("Could not fetch starter file %s: %v\n", file.RelativePath, saveErr)
+        return false, nil
+    }
+
+    // The student may have created the file while it was downloading
+    if _, err := os.Stat(dest); err == nil {
+        os.Remove(part)
+        return false, nil
+    }
+    if err := os.Rename(part, dest); err != nil {
+        os.Remove(part)
+        fmt.Printf("Could not fetch starter file %s: %v\n", file.RelativePath, err)
+        return false, nil
+    }
+    if !header.ModTime.IsZero() {
+        os.Chtimes(dest, time.Now(), header.ModTime)
+    }
+    fmt.Printf("Fetched starter file: %s\n", dest)
+    return true, nil
+}
+
+// shouldCompress skips tiny files and formats that are compressed already.
+func shouldCompress(path string) bool {
+    info, err := os.Stat(path)
+    if err != nil || info.Size() < minCompressSize {
+        return false
+    }
+    ext := strings.ToLower(filepath.Ext(path))
+    for _, skip := range compressedExtensions {
+        if ext == skip {
+            return false
+        }
+    }
+    return true
+}
+
+// queryResumeOffset asks the server how much of the file it already holds
+// from the interrupted connection.
+func queryResumeOffset(session *Session, relPath string, path string) (protocol.ResumeOffset, error) {
+    var reply protocol.ResumeOffset
+    info, err := os.Stat(path)
+    if err != nil {
+        return reply, err
+    }
+
+    if err := protocol.WriteJSONFrame(session.Writer, protocol.FrameResumeQuery, protocol.ResumeQuery{RelativePath: relPath, Size: info.Size()}); err != nil {
+        return reply, fmt.Errorf("error sending resume query: %v", err)
+    }
+    if err := session.Writer.Flush(); err != nil {
+        return reply, fmt.Errorf("error sending resume query: %v", err)
+    }
+    if err := protocol.ReadJSONFrame(session.Reader, protocol.FrameResumeReply, &reply); err != nil {
+        return reply, fmt.Errorf("error receiving resume offset: %v", err)
+    }
+    if reply.Offset > 0 {
+        fmt.Printf("Resuming %s at byte %d\n", relPath, reply.Offset)
+    }
+    return reply, nil
+}
+
+func searchAndSendFiles(rootPath string, patterns []string, policy protocol.Policy, session *Session) error {
     filesFound := false
     matchedFolders := make(map[string]bool)
+    var candidates []candidate
 
     // First pass: identify matching folders
-    if config.MatchFolders {
-        filepath.Walk(rootPath, func(path string, info os.FileInfo, err error) error {
+    if policy.MatchFolders {
+        err := filepath.Walk(rootPath, func(path string, info os.FileInfo, err error) error {
+            // Walking a large Documents folder can outlast the server's idle timeout
+            if beatErr := session.Heartbeat.Beat(); beatErr != nil {
+                return beatErr
+            }
             if err != nil || !info.IsDir() {
                 return nil
             }
-            if containsPattern(filepath.Base(path), patterns) {
+            if protocol.ContainsPattern(filepath.Base(path), patterns) {
                 matchedFolders[path] = true
                 filesFound = true
                 fmt.Printf("Found matching folder: %s\n", path)
             }
             return nil
         })
+        if err != nil {
+            return err
+        }
     }
 
-    // Second pass: process files and folders
+    // Second pass: collect files and folders
     err := filepath.Walk(rootPath, func(path string, info os.FileInfo, err error) error {
+        if beatErr := session.Heartbeat.Beat(); beatErr != nil {
+            return beatErr
+        }
         if err != nil {
             return nil
         }
 
-        if level := strings.Count(path[len(rootPath):], string(os.PathSeparator)); level > 5 {
+        if relPath, err := filepath.Rel(rootPath, path); err == nil && policy.TooDeep(relPath) {
             return filepath.SkipDir
         }
 
         // Check if this path is inside a matched folder
         inMatchedFolder := false
-        if config.MatchFolders {
+        if policy.MatchFolders {
             for folderPath := range matchedFolders {
                 if strings.HasPrefix(path, folderPath) {
                     inMatchedFolder = true
@@ -199,42 +943,33 @@ func searchAndSendFiles(rootPath string, patterns []string, conn net.Conn, hostn
             }
         }
 
-        // Handle folders
+        // Handle folders, including empty ones inside a matched folder so
+        // the server recreates the same tree
         if info.IsDir() {
-            if config.MatchFolders && containsPattern(filepath.Base(path), patterns) {
+            if inMatchedFolder {
                 relPath, err := filepath.Rel(rootPath, path)
                 if err != nil {
                     return err
                 }
 
-                fileInfo := FileInfo{
-                    RelativePath: relPath,
-                    Content:      nil,
-                    ClientIP:     getLocalIP(),
-                    Username:     hostname,
-                }
-
-                encoder := json.NewEncoder(conn)
-                if err := encoder.Encode(fileInfo); err != nil {
-                    return fmt.Errorf("error sending folder info: %v", err)
-                }
+                candidates = append(candidates, candidate{RelativePath: relPath, Info: info})
             }
             return nil
         }
 
         // Handle files
         shouldSendFile := false
-        if config.MatchFiles {
+        if policy.MatchFiles {
             // Send file if its name matches pattern
-            shouldSendFile = containsPattern(filepath.Base(path), patterns)
+            shouldSendFile = protocol.ContainsPattern(filepath.Base(path), patterns)
         }
-        if config.MatchFolders {
+        if policy.MatchFolders {
             // Send file if it's inside a matched folder
             shouldSendFile = shouldSendFile || inMatchedFolder
         }
 
         if shouldSendFile {
-            if config.FilterExts && !isValidExtension(path) {
+            if len(policy.Extensions) > 0 && !protocol.IsValidExtension(path, policy.Extensions) {
                 return nil
             }
 
@@ -244,42 +979,345 @@ func searchAndSendFiles(rootPath string, patterns []string, conn net.Conn, hostn
                 return err
             }
 
-            content, err := os.ReadFile(path)
-            if err != nil {
-                fmt.Printf("Error reading file %s: %v\n", path, err)
-                return nil
-            }
+            candidates = append(candidates, candidate{Path: path, RelativePath: relPath, Info: info})
+        }
+        return nil
+    })
+    if err != nil {
+        return err
+    }
 
-            fileInfo := FileInfo{
-                RelativePath: relPath,
-                Content:      content,
-                ClientIP:     getLocalIP(),
-                Username:     hostname,
+    if !filesFound {
+        fmt.Println("No matching files or folders found")
+    }
+
+    // With delta sync the server finds deletions in the listing, which also
+    // covers the ones from before this program was restarted
+    if protocol.HasFeature(session.Welcome.Features, protocol.CapFileEvents) && !protocol.HasFeature(session.Welcome.Features, protocol.CapDeltaSync) {
+        if err := sendDeletions(session, candidates); err != nil {
+            return err
+        }
+    }
+
+    if protocol.HasFeature(session.Welcome.Features, protocol.CapDeltaSync) {
+        candidates, err = skipHeldFiles(session, candidates)
+        if err != nil {
+            return err
+        }
+    }
+
+    for _, c := range candidates {
+        header := protocol.FileHeader{
+            RelativePath: c.RelativePath,
+            IsDir:        c.Info.IsDir(),
+            ModTime:      c.Info.ModTime(),
+            Mode:         c.Info.Mode().Perm(),
+        }
+
+        if !header.IsDir {
+            if err := checkLimits(session, c.Info.Size()); err != nil {
+                fmt.Printf("Skipping %s: %v\n", c.Path, err)
+                session.Manifest = append(session.Manifest, protocol.ManifestEntry{RelativePath: c.RelativePath, Size: c.Info.Size()})
+                if err := reportError(session, c.RelativePath, err); err != nil {
+                    return err
+                }
+                continue
             }
+        }
 
-            encoder := json.NewEncoder(conn)
-            if err := encoder.Encode(fileInfo); err != nil {
-                return fmt.Errorf("error sending file info: %v", err)
+        if err := deliverFile(session, header, c.Path); err != nil {
+            if header.IsDir {
+                return fmt.Errorf("error sending folder info: %v", err)
             }
+            if _, ok := err.(*os.PathError); ok {
+                fmt.Printf("Error reading file %s: %v\n", c.Path, err)
+                session.Manifest = append(session.Manifest, protocol.ManifestEntry{RelativePath: c.RelativePath, Size: c.Info.Size()})
+                if err := reportError(session, c.RelativePath, err); err != nil {
+                    return err
+                }
+                continue
+            }
+            return err
+        }
 
-            fmt.Printf("Sent file: %s\n", relPath)
+        if !header.IsDir {
+            session.FilesSent++
+            session.BytesSent += c.Info.Size()
+            fmt.Printf("Sent file: %s\n", c.RelativePath)
         }
+    }
+    return nil
+}
+
+// checkLimits refuses a file the server would reject for its limits, so the
+// session goes on with the other files instead of being cut off.
+func checkLimits(session *Session, size int64) error {
+    limits := session.Welcome.Limits
+    switch {
+    case limits.MaxFileSize > 0 && size > limits.MaxFileSize:
+        return fmt.Errorf("larger than the server limit of %d bytes", limits.MaxFileSize)
+    case limits.MaxFiles > 0 && session.FilesSent >= limits.MaxFiles:
+        return fmt.Errorf("server limit of %d files per session reached", limits.MaxFiles)
+    case limits.MaxSessionBytes > 0 && session.BytesSent+size > limits.MaxSessionBytes:
+        return fmt.Errorf("server limit of %d bytes per session reached", limits.MaxSessionBytes)
+    }
+    return nil
+}
+
+// sendDeletions tells the server about everything the previous session sent
+// that is no longer among the candidates.
+func sendDeletions(session *Session, candidates []candidate) error {
+    current := make(map[string]bool)
+    for _, c := range candidates {
+        current[c.RelativePath] = true
+    }
+
+    var deleted []string
+    for relPath := range session.Previous {
+        if !current[relPath] {
+            deleted = append(deleted, relPath)
+        }
+    }
+    sort.Strings(deleted)
+
+    for _, relPath := range deleted {
+        del := protocol.FileDelete{RelativePath: relPath, IsDir: session.Previous[relPath]}
+        if err := protocol.WriteJSONFrame(session.Writer, protocol.FrameDelete, del); err != nil {
+            return fmt.Errorf("error sending delete record: %v", err)
+        }
+        fmt.Printf("Deleted since last session: %s\n", relPath)
+    }
+    return session.Writer.Flush()
+}
+
+// reportError forwards a local error, like a file that could not be read,
+// to the server when it records client errors; older servers only get the
+// missing file in the manifest.
+func reportError(session *Session, relPath string, readErr error) error {
+    if !protocol.HasFeature(session.Welcome.Features, protocol.CapFileEvents) {
         return nil
-    })
+    }
+    if err := protocol.WriteJSONFrame(session.Writer, protocol.FrameClientError, protocol.ClientError{RelativePath: relPath, Error: readErr.Error()}); err != nil {
+        return fmt.Errorf("error sending error report: %v", err)
+    }
+    return session.Writer.Flush()
+}
 
-    if !filesFound {
-        fmt.Println("No matching files or folders found")
+// skipHeldFiles lists the candidates with their hashes and returns only the
+// ones the server asks for. The rest go straight into the manifest, the
+// server already holds them.
+func skipHeldFiles(session *Session, candidates []candidate) ([]candidate, error) {
+    listing := make([]protocol.ListingEntry, len(candidates))
+    for i, c := range candidates {
+        entry := protocol.ListingEntry{
+            RelativePath: c.RelativePath,
+            IsDir:        c.Info.IsDir(),
+            ModTime:      c.Info.ModTime(),
+        }
+        if err := session.Heartbeat.Beat(); err != nil {
+            return nil, err
+        }
+        if !entry.IsDir {
+            entry.Size = c.Info.Size()
+            // Unreadable files go without a hash, so the server wants them
+            // and the read error is reported when sending
+            entry.SHA256, _ = fileHash(c.Path, c.Info)
+        }
+        listing[i] = entry
+
+        if err := protocol.WriteJSONFrame(session.Writer, protocol.FrameListing, entry); err != nil {
+            return nil, fmt.Errorf("error sending listing: %v", err)
+        }
+    }
+    if err := protocol.WriteJSONFrame(session.Writer, protocol.FrameListingEnd, protocol.ListingEnd{Files: len(listing)}); err != nil {
+        return nil, fmt.Errorf("error sending listing: %v", err)
+    }
+    if err := session.Writer.Flush(); err != nil {
+        return nil, fmt.Errorf("error sending listing: %v", err)
+    }
+
+    var wanted protocol.WantedFiles
+    if err := protocol.ReadJSONFrame(session.Reader, protocol.FrameWanted, &wanted); err != nil {
+        return nil, fmt.Errorf("error receiving wanted files: %v", err)
+    }
+
+    want := make([]bool, len(candidates))
+    for _, i := range wanted.Indexes {
+        if i >= 0 && i < len(want) {
+            want[i] = true
+        }
+    }
+
+    var send []candidate
+    for i, c := range candidates {
+        if want[i] {
+            send = append(send, c)
+            continue
+        }
+        entry := listing[i]
+        session.Manifest = append(session.Manifest, protocol.ManifestEntry{
+            RelativePath: entry.RelativePath,
+            IsDir:        entry.IsDir,
+            Size:         entry.Size,
+            SHA256:       entry.SHA256,
+        })
+    }
+    fmt.Printf("Server already holds %d of %d files, sending %d\n", len(candidates)-len(send), len(candidates), len(send))
+    return send, nil
+}
+
+// fileHash returns the SHA-256 of a file, reusing the digest from an
+// earlier session while its size and modification time stay the same.
+func fileHash(path string, info os.FileInfo) (string, error) {
+    if cached, ok := hashCache[path]; ok && cached.Size == info.Size() && cached.ModTime.Equal(info.ModTime()) {
+        return cached.SHA256, nil
+    }
+
+    f, err := os.Open(path)
+    if err != nil {
+        return "", err
+    }
+    defer f.Close()
+
+    h := sha256.New()
+    if _, err := io.Copy(h, f); err != nil {
+        return "", err
+    }
+    sum := hex.EncodeToString(h.Sum(nil))
+    hashCache[path] = hashCacheEntry{Size: info.Size(), ModTime: info.ModTime(), SHA256: sum}
+    return sum, nil
+}
+
+// loadPin returns the fingerprint the server certificate must match, from
+// --pin or from the lab certificate file. Everything stays offline.
+func loadPin(config Config) (string, error) {
+    if config.Pin != "" {
+        return config.Pin, nil
+    }
+
+    candidates := []string{config.CertFile}
+    if config.CertFile == "" {
+        candidates = []string{CERT_FILE}
+        if exe, err := os.Executable(); err == nil {
+            candidates = append([]string{filepath.Join(filepath.Dir(exe), CERT_FILE)}, candidates...)
+        }
+    }
+
+    for _, path := range candidates {
+        data, err := os.ReadFile(path)
+        if err != nil {
+            continue
+        }
+        block, _ := pem.Decode(data)
+        if block == nil || block.Type != "CERTIFICATE" {
+            return "", fmt.Errorf("%s is not a PEM certificate", path)
+        }
+        sum := sha256.Sum256(block.Bytes)
+        return hex.EncodeToString(sum[:]), nil
     }
+    return "", fmt.Errorf("no lab certificate found (tried %v); use --cert, --pin or --no-tls", candidates)
+}
 
-    return err
+func normalizeFingerprint(s string) string {
+    s = strings.ToLower(s)
+    s = strings.ReplaceAll(s, ":", "")
+    return strings.ReplaceAll(s, " ", "")
 }
 
-func connectWithRetry(serverIP string) (net.Conn, error) {
+// pinnedTLSConfig trusts exactly one certificate: the lab's self-signed one.
+func pinnedTLSConfig(pin string) *tls.Config {
+    return &tls.Config{
+        // No CA signs the lab certificate; VerifyPeerCertificate checks the pin
+        InsecureSkipVerify: true,
+        MinVersion:         tls.VersionTLS12,
+        VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+            if len(rawCerts) == 0 {
+                return errors.New("server sent no certificate")
+            }
+            sum := sha256.Sum256(rawCerts[0])
+            if got := hex.EncodeToString(sum[:]); got != pin {
+                return fmt.Errorf("server certificate %s does not match the pinned lab certificate", got)
+            }
+            return nil
+        },
+    }
+}
+
+// discoverServer listens for server beacons and returns the address of the
+// server announcing the session name, or of the only server heard when no
+// name is given.
+func discoverServer(name string, timeout time.Duration) (string, error) {
+    pc, err := net.ListenPacket("udp4", fmt.Sprintf(":%d", protocol.DISCOVERY_PORT))
+    if err != nil {
+        return "", fmt.Errorf("error listening for beacons: %v", err)
+    }
+    defer pc.Close()
+    pc.SetReadDeadline(time.Now().Add(timeout))
+
+    found := make(map[string]string) // session name -> address
+    buf := make([]byte, 2048)
+    for {
+        n, addr, err := pc.ReadFrom(buf)
+        if ne, ok := err.(net.Error); ok && ne.Timeout() {
+            break
+        }
+        if err != nil {
+            return "", fmt.Errorf("error receiving beacon: %v", err)
+        }
+
+        var beacon protocol.Beacon
+        if json.Unmarshal(buf[:n], &beacon) != nil || beacon.Magic != protocol.BeaconMagic {
+            continue
+        }
+        host := beacon.Address
+        if host == "" {
+            host = addr.(*net.UDPAddr).IP.String()
+        }
+        address := net.JoinHostPort(host, strconv.Itoa(beacon.Port))
+        if name != "" && beacon.Name == name {
+            return address, nil
+        }
+        found[beacon.Name] = address
+    }
+
+    if name != "" {
+        return "", fmt.Errorf("no server announcing session %q (heard %d others)", name, len(found))
+    }
+    switch len(found) {
+    case 0:
+        return "", fmt.Errorf("no server heard within %v", timeout)
+    case 1:
+        for _, address := range found {
+            return address, nil
+        }
+    }
+    var names []string
+    for n := range found {
+        names = append(names, n)
+    }
+    sort.Strings(names)
+    return "", fmt.Errorf("several servers found, pick one with --session: %q", names)
+}
+
+func connectWithRetry(serverIP string, tlsConfig *tls.Config, timeout time.Duration) (net.Conn, error) {
     maxRetries := 100 // Limit retries to prevent infinite loop
     retryCount := 0
     
     for retryCount < maxRetries {
-        conn, err := net.Dial("tcp", serverIP)
+        conn, err := net.DialTimeout("tcp", serverIP, timeout)
+        if err == nil && tlsConfig != nil {
+            tlsConn := tls.Client(conn, tlsConfig)
+            if timeout > 0 {
+                conn.SetDeadline(time.Now().Add(timeout))
+            }
+            if err = tlsConn.Handshake(); err != nil {
+                conn.Close()
+                fmt.Printf("TLS handshake failed: %v\n", err)
+            } else {
+                conn.SetDeadline(time.Time{})
+                conn = tlsConn
+            }
+        }
         if err == nil {
             fmt.Println("Connected to server successfully")
             return conn, nil
@@ -293,18 +1331,6 @@ func connectWithRetry(serverIP string) (net.Conn, error) {
     return nil, fmt.Errorf("failed to connect after %d attempts", maxRetries)
 }
 
-func getPathPatternsFromServer(conn net.Conn) ([]string, error) {
-    decoder := json.NewDecoder(conn)
-    var patterns []string
-    
-    if err := decoder.Decode(&patterns); err != nil {
-        return nil, fmt.Errorf("error receiving patterns from server: %v", err)
-    }
-    
-    fmt.Printf("Received patterns from server: %v\n", patterns)
-    return patterns, nil
-}
-
 func getDocumentsPath() (string, error) {
     // For Windows
     home := os.Getenv("USERPROFILE")
@@ -0,0 +1,12 @@
+module labgo
+
+go 1.21
+
+require (
+	labgo/protocol v0.0.0
+	labgo/s3 v0.0.0
+)
+
+replace labgo/protocol => ./protocol
+
+replace labgo/s3 => ./s3
\ No newline at end of file
@@ -0,0 +1,579 @@
+// Package protocol is the wire protocol shared by client.go and server.go:
+// the message types, framing and the helpers both ends must agree on. It is
+// a module of its own so its tests run without the standalone programs
+// next to client.go and server.go:
+//
+//     cd protocol && go test ./...
+//
+// The binaries are built from the parent folder, whose go.mod points here:
+//
+//     go build client.go
+//     go build server.go
+package protocol
+
+import (
+    "bufio"
+    "compress/flate"
+    "compress/gzip"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/binary"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "io"
+    "net"
+    "os"
+    "path/filepath"
+    "strings"
+    "time"
+)
+
+// Hello is the first message of every session. Fields unknown to the
+// receiver are ignored so either side can grow the message.
+type Hello struct {
+    ProtocolVersion int
+    MachineID       string
+    PairingCode     string // only set while enrolling
+    Hostname        string
+    ClientIP        string
+    AgentVersion    string
+    Capabilities    []string
+    ResumeSessionID string
+    Codecs          []string // compression codecs, most preferred first
+}
+
+// Welcome answers Hello. A non-empty Error means the server refused the
+// session and is about to close the connection.
+type Welcome struct {
+    ProtocolVersion int
+    ServerVersion   string
+    SessionID       string
+    Resumed         bool
+    Features        []string
+    Codec           string // compression the client may use, "" for none
+    Patterns        []string
+    Policy          Policy
+    Limits          Limits
+    Distribution    *Distribution // starter files to hand out, nil for none
+    EnrolledKey     string // the client's new key, only after enrolling
+    Error           string
+}
+
+// Policy decides what the client collects. It is owned by the server and
+// pushed in Welcome; local flags only override it when AllowOverride is set.
+type Policy struct {
+    MatchFiles    bool
+    MatchFolders  bool
+    Extensions    []string // empty means every extension
+    MaxDepth      int      // 0 means unlimited
+    AllowOverride bool
+}
+
+// TooDeep reports whether a path relative to the search folder lies deeper
+// than MaxDepth, counted in path elements: with MaxDepth 2 "UAS/main.c" is
+// collected and "UAS/sub/main.c" is not. The client walk and the server's
+// HTTP upload check both use it, so they cannot disagree.
+func (p Policy) TooDeep(relPath string) bool {
+    return p.MaxDepth > 0 && Depth(relPath) > p.MaxDepth
+}
+
+// Depth is the number of elements of a relative path, taking either
+// separator; the search folder itself is 0.
+func Depth(relPath string) int {
+    p := strings.Trim(strings.ReplaceAll(relPath, "\\", "/"), "/")
+    if p == "" || p == "." {
+        return 0
+    }
+    return strings.Count(p, "/") + 1
+}
+
+// Limits are the server's resource caps for one session, announced in
+// Welcome so clients can skip what would be refused anyway. Zero means
+// unlimited.
+type Limits struct {
+    MaxFileSize     int64
+    MaxFiles        int
+    MaxSessionBytes int64
+}
+
+// Rejection ends a session that ran into a resource limit. The server
+// closes the connection after sending it.
+type Rejection struct {
+    Reason string
+}
+
+// Beacon is broadcast by the server on DISCOVERY_PORT every few seconds so
+// clients started without a server address can find it.
+type Beacon struct {
+    Magic         string // BeaconMagic, anything else on the port is ignored
+    Name          string // session name, picked on the client with --session
+    Address       string // empty means the address the beacon came from
+    Port          int
+    ServerVersion string
+}
+
+// Challenge is sent to the client right after Hello when authentication is
+// enabled; the client must answer with an AuthResponse.
+type Challenge struct {
+    Nonce string
+}
+
+// AuthResponse carries AuthMAC over the challenge nonce and the identity
+// claimed in Hello, keyed with the client's enrolled key.
+type AuthResponse struct {
+    MAC string
+}
+
+// FileHeader opens a file transfer. It is followed by zero or more data
+// frames carrying the raw content and a FileTrailer closing the transfer.
+type FileHeader struct {
+    RelativePath string
+    IsDir        bool
+    Size         int64
+    Offset       int64 // the data frames start at this offset of the file
+    Encoding     string // codec compressing the data frames, "" for raw bytes
+    ModTime      time.Time   // last modification on the client
+    Mode         os.FileMode // permission bits on the client
+}
+
+// Validate rejects headers no well-behaved client sends: paths that are
+// absolute or climb out of the submission folder, impossible sizes and
+// encodings this build does not know.
+func (h FileHeader) Validate() error {
+    p := strings.ReplaceAll(h.RelativePath, "\\", "/")
+    switch {
+    case p == "" || strings.HasPrefix(p, "/") || filepath.IsAbs(h.RelativePath) || filepath.VolumeName(h.RelativePath) != "":
+        return fmt.Errorf("invalid path %q", h.RelativePath)
+    case p == ".." || strings.HasPrefix(p, "../") || strings.HasSuffix(p, "/..") || strings.Contains(p, "/../"):
+        return fmt.Errorf("path %q leaves the submission folder", h.RelativePath)
+    case h.Size < 0 || h.Offset < 0 || h.Offset > h.Size:
+        return fmt.Errorf("invalid size %d at offset %d", h.Size, h.Offset)
+    case h.IsDir && (h.Size != 0 || h.Encoding != ""):
+        return fmt.Errorf("folder %q with content", h.RelativePath)
+    }
+    if _, ok := Codecs[h.Encoding]; h.Encoding != "" && !ok {
+        return fmt.Errorf("unknown encoding %q", h.Encoding)
+    }
+    return nil
+}
+
+// FileTrailer closes a file transfer. SHA256 is the hex digest of the
+// content as read by the client.
+type FileTrailer struct {
+    Size   int64
+    SHA256 string
+}
+
+// ResumeQuery asks where an interrupted transfer of a file can continue.
+type ResumeQuery struct {
+    RelativePath string
+    Size         int64
+}
+
+// ResumeOffset answers ResumeQuery. PrefixSHA256 is the digest of the first
+// Offset bytes the server holds, so the client can check that its copy of
+// the file has not changed in the meantime.
+type ResumeOffset struct {
+    RelativePath string
+    Offset       int64
+    PrefixSHA256 string
+}
+
+// FileAck tells the client whether a file was stored and verified. SHA256
+// is the digest of the file as read back from the server's disk.
+type FileAck struct {
+    RelativePath string
+    OK           bool
+    SHA256       string
+    Error        string
+}
+
+// FileDelete records that a file or folder sent in an earlier session is
+// gone from the client. The server keeps its copy and logs the deletion.
+type FileDelete struct {
+    RelativePath string
+    IsDir        bool
+}
+
+// ClientError reports a file the client wanted to send but could not read,
+// so the failure ends up in the server's records and not only on the PC.
+type ClientError struct {
+    RelativePath string
+    Error        string
+}
+
+// ManifestEntry lists one file the client meant to send in the session. The
+// manifest goes out at the end of the session as one frame per entry,
+// closed by ManifestEnd.
+type ManifestEntry struct {
+    RelativePath string
+    IsDir        bool
+    Size         int64
+    SHA256       string // empty when the client could not read the file
+}
+
+// ManifestEnd closes the manifest. Files is the number of entries sent, so
+// a manifest cut short is not mistaken for a small submission.
+type ManifestEnd struct {
+    Files int
+}
+
+// SubmissionStatus is the server's verdict after reconciling the manifest
+// with the files it stored in the session.
+type SubmissionStatus struct {
+    Status  string // StatusComplete, StatusIncomplete or StatusCorrupt
+    Files   int
+    Missing []string // listed in the manifest but never stored
+    Corrupt []string // stored with a different size or hash
+}
+
+// ListingEntry describes a local file before anything is sent. With delta
+// sync the client lists every file it would send and the server answers
+// with the ones it does not already hold.
+type ListingEntry struct {
+    RelativePath string
+    IsDir        bool
+    Size         int64
+    ModTime      time.Time
+    SHA256       string // empty when the client could not read the file
+}
+
+// ListingEnd closes the listing.
+type ListingEnd struct {
+    Files int
+}
+
+// WantedFiles answers the listing with the indexes of the entries the
+// client has to send. Everything else is already held by the server.
+type WantedFiles struct {
+    Indexes []int
+}
+
+// Distribution lists the starter files the server hands out at the start
+// of an exam. Clients put them in the folder named Target inside their
+// search path and fetch the ones they lack with a WantedFiles request; the
+// server answers with a FileHeader, data frames and a FileTrailer for each,
+// in the order requested.
+type Distribution struct {
+    Target string
+    Files  []DistFile
+}
+
+// DistFile is one entry of a Distribution. SHA256 is empty for folders.
+type DistFile struct {
+    RelativePath string
+    IsDir        bool
+    Size         int64
+    SHA256       string
+}
+
+const (
+    Magic   = "LABGO\n"
+    Version = 2
+    BeaconMagic     = "LABGO-BEACON"
+    DISCOVERY_PORT  = 8081
+
+    CapChunkedTransfer = "chunked-transfer"
+    CapServerPolicy    = "server-policy"
+    CapFileAck         = "sha256-ack"
+    CapResume          = "resume"
+    CapManifest        = "manifest"
+    CapDeltaSync       = "delta-sync"
+    CapFileEvents      = "file-events"
+    CapHeartbeat       = "heartbeat"
+    CapDistribution    = "distribution"
+
+    HeartbeatInterval = 15 * time.Second
+
+    StatusComplete   = "complete"
+    StatusIncomplete = "incomplete"
+    StatusCorrupt    = "corrupt"
+)
+
+// Codec compresses file data on the wire. Adding a codec only takes an
+// entry in Codecs and CodecPreference; the handshake picks the first one
+// both sides know.
+type Codec struct {
+    NewWriter func(w io.Writer) io.WriteCloser
+    NewReader func(r io.Reader) (io.ReadCloser, error)
+}
+
+var Codecs = map[string]Codec{
+    "gzip": {
+        NewWriter: func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) },
+        NewReader: func(r io.Reader) (io.ReadCloser, error) { return gzip.NewReader(r) },
+    },
+    "deflate": {
+        NewWriter: func(w io.Writer) io.WriteCloser {
+            fw, _ := flate.NewWriter(w, flate.DefaultCompression)
+            return fw
+        },
+        NewReader: func(r io.Reader) (io.ReadCloser, error) { return flate.NewReader(r), nil },
+    },
+}
+
+var CodecPreference = []string{"gzip", "deflate"}
+
+// Frame types. Every frame is a 1 byte type, a 4 byte big-endian payload
+// length and the payload itself. Data frames are never larger than
+// ChunkSize and control frames never larger than MaxControlFrame.
+const (
+    FrameHello       byte = 'H'
+    FrameWelcome     byte = 'W'
+    FrameChallenge   byte = 'C'
+    FrameAuth        byte = 'P'
+    FrameFileHeader  byte = 'F'
+    FrameFileData    byte = 'D'
+    FrameFileTrailer byte = 'T'
+    FrameFileAck     byte = 'A'
+    FrameResumeQuery byte = 'Q'
+    FrameResumeReply byte = 'R'
+    FrameManifest    byte = 'M'
+    FrameManifestEnd byte = 'E'
+    FrameSubmission  byte = 'S'
+    FrameListing     byte = 'L'
+    FrameListingEnd  byte = 'Z'
+    FrameWanted      byte = 'N'
+    FrameDelete      byte = 'X'
+    FrameClientError byte = '!'
+    FrameHeartbeat   byte = 'B' // empty, skipped by ReadControlFrame
+    FrameRejected    byte = 'J'
+    FrameDistRequest byte = 'G' // WantedFiles, indexes into Welcome.Distribution
+
+    ChunkSize       = 32 * 1024
+    MaxControlFrame = 64 * 1024
+)
+
+func IsValidExtension(path string, extensions []string) bool {
+    ext := strings.ToLower(filepath.Ext(path))
+    for _, allowed := range extensions {
+        if ext == strings.ToLower(allowed) {
+            return true
+        }
+    }
+    return false
+}
+
+func ContainsPattern(path string, patterns []string) bool {
+    pathLower := strings.ToLower(path)
+    for _, pattern := range patterns {
+        if strings.Contains(pathLower, strings.ToLower(pattern)) {
+            return true
+        }
+    }
+    return false
+}
+
+func WriteFrame(w io.Writer, frameType byte, payload []byte) error {
+    var hdr [5]byte
+    hdr[0] = frameType
+    binary.BigEndian.PutUint32(hdr[1:], uint32(len(payload)))
+    if _, err := w.Write(hdr[:]); err != nil {
+        return err
+    }
+    _, err := w.Write(payload)
+    return err
+}
+
+func WriteJSONFrame(w io.Writer, frameType byte, v interface{}) error {
+    payload, err := json.Marshal(v)
+    if err != nil {
+        return err
+    }
+    return WriteFrame(w, frameType, payload)
+}
+
+func ReadFrameHeader(r io.Reader) (byte, uint32, error) {
+    var hdr [5]byte
+    if _, err := io.ReadFull(r, hdr[:]); err != nil {
+        if err == io.ErrUnexpectedEOF {
+            return 0, 0, fmt.Errorf("connection closed inside a frame header")
+        }
+        return 0, 0, err
+    }
+    return hdr[0], binary.BigEndian.Uint32(hdr[1:]), nil
+}
+
+// ReadControlFrame reads one frame whose payload is small enough to be held
+// in memory. A clean EOF before the frame is returned as io.EOF.
+func ReadControlFrame(r io.Reader) (byte, []byte, error) {
+    for {
+        frameType, length, err := ReadFrameHeader(r)
+        if err != nil {
+            return 0, nil, err
+        }
+        if length > MaxControlFrame {
+            return 0, nil, fmt.Errorf("frame %q too large: %d bytes", frameType, length)
+        }
+        payload := make([]byte, length)
+        if _, err := io.ReadFull(r, payload); err != nil {
+            return 0, nil, fmt.Errorf("error reading frame %q: %v", frameType, err)
+        }
+        if frameType == FrameHeartbeat {
+            continue
+        }
+        return frameType, payload, nil
+    }
+}
+
+// ReadJSONFrame reads one control frame of the expected type and decodes its
+// payload into v.
+func ReadJSONFrame(r io.Reader, want byte, v interface{}) error {
+    frameType, payload, err := ReadControlFrame(r)
+    if err != nil {
+        return err
+    }
+    if frameType == FrameRejected && want != FrameRejected {
+        var rejection Rejection
+        json.Unmarshal(payload, &rejection)
+        return fmt.Errorf("server rejected the session: %s", rejection.Reason)
+    }
+    if frameType != want {
+        return fmt.Errorf("unexpected frame %q, want %q", frameType, want)
+    }
+    return json.Unmarshal(payload, v)
+}
+
+// AuthMAC binds the challenge nonce to the identity the client claims in
+// Hello, so a captured response cannot be replayed under another name.
+func AuthMAC(key []byte, nonce string, hello Hello) string {
+    mac := hmac.New(sha256.New, key)
+    fmt.Fprintf(mac, "LABGO-AUTH\n%s\n%s\n%s\n%s\n", nonce, hello.MachineID, hello.Hostname, hello.ClientIP)
+    return hex.EncodeToString(mac.Sum(nil))
+}
+
+func HasFeature(features []string, name string) bool {
+    for _, f := range features {
+        if f == name {
+            return true
+        }
+    }
+    return false
+}
+
+// DeadlineConn moves the read or write deadline forward before every call,
+// so a connection only times out once the peer has gone quiet. A zero
+// timeout leaves the deadline alone.
+type DeadlineConn struct {
+    net.Conn
+    ReadTimeout  time.Duration
+    WriteTimeout time.Duration
+}
+
+func (c *DeadlineConn) Read(p []byte) (int, error) {
+    if c.ReadTimeout > 0 {
+        c.Conn.SetReadDeadline(time.Now().Add(c.ReadTimeout))
+    }
+    return c.Conn.Read(p)
+}
+
+func (c *DeadlineConn) Write(p []byte) (int, error) {
+    if c.WriteTimeout > 0 {
+        c.Conn.SetWriteDeadline(time.Now().Add(c.WriteTimeout))
+    }
+    return c.Conn.Write(p)
+}
+
+// Heartbeat sends an empty frame at most every HeartbeatInterval, keeping
+// the peer's timeout from firing while this side is busy with nothing to
+// send. A nil heartbeat, when the peer does not support it, does nothing.
+type Heartbeat struct {
+    W    *bufio.Writer
+    Last time.Time
+}
+
+func (hb *Heartbeat) Beat() error {
+    if hb == nil || time.Since(hb.Last) < HeartbeatInterval {
+        return nil
+    }
+    hb.Last = time.Now()
+    if err := WriteFrame(hb.W, FrameHeartbeat, nil); err != nil {
+        return err
+    }
+    return hb.W.Flush()
+}
+
+// ChunkWriter splits everything written to it into data frames of at most
+// ChunkSize bytes, so io.Copy can stream a file without buffering it whole.
+type ChunkWriter struct {
+    W       io.Writer
+    Written int64
+}
+
+func (cw *ChunkWriter) Write(p []byte) (int, error) {
+    total := 0
+    for len(p) > 0 {
+        n := len(p)
+        if n > ChunkSize {
+            n = ChunkSize
+        }
+        if err := WriteFrame(cw.W, FrameFileData, p[:n]); err != nil {
+            return total, err
+        }
+        total += n
+        cw.Written += int64(n)
+        p = p[n:]
+    }
+    return total, nil
+}
+
+// ChunkReader exposes the data frames following a FileHeader as a plain
+// stream. It returns io.EOF once the FileTrailer has been read.
+type ChunkReader struct {
+    R         io.Reader
+    remaining uint32
+    Received  int64
+    Trailer   FileTrailer
+    done      bool
+}
+
+func (cr *ChunkReader) Read(p []byte) (int, error) {
+    for cr.remaining == 0 {
+        if cr.done {
+            return 0, io.EOF
+        }
+        frameType, length, err := ReadFrameHeader(cr.R)
+        if err == io.EOF {
+            return 0, io.ErrUnexpectedEOF
+        }
+        if err != nil {
+            return 0, err
+        }
+        switch frameType {
+        case FrameFileData:
+            if length > ChunkSize {
+                return 0, fmt.Errorf("data frame too large: %d bytes", length)
+            }
+            cr.remaining = length
+        case FrameFileTrailer:
+            if length > MaxControlFrame {
+                return 0, fmt.Errorf("trailer frame too large: %d bytes", length)
+            }
+            payload := make([]byte, length)
+            if _, err := io.ReadFull(cr.R, payload); err != nil {
+                if err == io.EOF {
+                    err = io.ErrUnexpectedEOF
+                }
+                return 0, err
+            }
+            if err := json.Unmarshal(payload, &cr.Trailer); err != nil {
+                return 0, fmt.Errorf("invalid file trailer: %v", err)
+            }
+            cr.done = true
+        default:
+            return 0, fmt.Errorf("unexpected frame %q inside file transfer", frameType)
+        }
+    }
+
+    if uint32(len(p)) > cr.remaining {
+        p = p[:cr.remaining]
+    }
+    n, err := cr.R.Read(p)
+    cr.remaining -= uint32(n)
+    cr.Received += int64(n)
+    if err == io.EOF {
+        err = io.ErrUnexpectedEOF
+    }
+    return n, err
+}
\ No newline at end of file
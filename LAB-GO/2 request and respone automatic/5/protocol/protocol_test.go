@@ -0,0 +1,388 @@
+package protocol
+
+import (
+    "bufio"
+    "bytes"
+    "crypto/sha256"
+    "encoding/hex"
+    "errors"
+    "io"
+    "path"
+    "reflect"
+    "strings"
+    "testing"
+    "time"
+)
+
+var modTime = time.Date(2024, 6, 10, 10, 47, 0, 0, time.UTC)
+
+// frameCases holds one message for every control frame type, filled in
+// enough that a field lost on the way shows up.
+var frameCases = []struct {
+    frameType byte
+    message   interface{}
+}{
+    {FrameHello, &Hello{ProtocolVersion: Version, MachineID: "2af7", PairingCode: "123456", Hostname: "lab01", ClientIP: "10.0.0.5",
+        AgentVersion: "5.2", Capabilities: []string{CapResume, CapManifest}, ResumeSessionID: "abc", Codecs: CodecPreference}},
+    {FrameWelcome, &Welcome{ProtocolVersion: Version, ServerVersion: "5.2", SessionID: "abc", Resumed: true, Features: []string{CapDeltaSync},
+        Codec: "gzip", Patterns: []string{"UAS"}, Policy: Policy{MatchFiles: true, Extensions: []string{".c"}, MaxDepth: 3},
+        Limits: Limits{MaxFileSize: 1 << 20, MaxFiles: 10, MaxSessionBytes: 1 << 30},
+        Distribution: &Distribution{Target: "UAS", Files: []DistFile{{RelativePath: "soal.pdf", Size: 3, SHA256: "ab"}}},
+        EnrolledKey: "key", Error: "refused"}},
+    {FrameChallenge, &Challenge{Nonce: "n0nce"}},
+    {FrameAuth, &AuthResponse{MAC: "mac"}},
+    {FrameFileHeader, &FileHeader{RelativePath: "UAS/main.c", Size: 10, Offset: 4, Encoding: "gzip", ModTime: modTime, Mode: 0644}},
+    {FrameFileTrailer, &FileTrailer{Size: 10, SHA256: "ab"}},
+    {FrameFileAck, &FileAck{RelativePath: "UAS/main.c", OK: true, SHA256: "ab", Error: "none"}},
+    {FrameResumeQuery, &ResumeQuery{RelativePath: "UAS/big.bin", Size: 1 << 30}},
+    {FrameResumeReply, &ResumeOffset{RelativePath: "UAS/big.bin", Offset: 4096, PrefixSHA256: "ab"}},
+    {FrameManifest, &ManifestEntry{RelativePath: "UAS", IsDir: true}},
+    {FrameManifestEnd, &ManifestEnd{Files: 3}},
+    {FrameSubmission, &SubmissionStatus{Status: StatusIncomplete, Files: 2, Missing: []string{"a"}, Corrupt: []string{"b"}}},
+    {FrameListing, &ListingEntry{RelativePath: "UAS/main.c", Size: 10, ModTime: modTime, SHA256: "ab"}},
+    {FrameListingEnd, &ListingEnd{Files: 1}},
+    {FrameWanted, &WantedFiles{Indexes: []int{0, 2}}},
+    {FrameDelete, &FileDelete{RelativePath: "UAS/old.c"}},
+    {FrameClientError, &ClientError{RelativePath: "UAS/locked.c", Error: "permission denied"}},
+    {FrameRejected, &Rejection{Reason: "too many files"}},
+    {FrameDistRequest, &WantedFiles{Indexes: []int{1}}},
+}
+
+func TestJSONFrameRoundTrip(t *testing.T) {
+    for _, tc := range frameCases {
+        var buf bytes.Buffer
+        if err := WriteJSONFrame(&buf, tc.frameType, tc.message); err != nil {
+            t.Fatalf("frame %q: write: %v", tc.frameType, err)
+        }
+        got := reflect.New(reflect.TypeOf(tc.message).Elem()).Interface()
+        if err := ReadJSONFrame(&buf, tc.frameType, got); err != nil {
+            t.Fatalf("frame %q: read: %v", tc.frameType, err)
+        }
+        if !reflect.DeepEqual(got, tc.message) {
+            t.Errorf("frame %q: got %+v, want %+v", tc.frameType, got, tc.message)
+        }
+        if buf.Len() != 0 {
+            t.Errorf("frame %q: %d bytes left over", tc.frameType, buf.Len())
+        }
+    }
+}
+
+func TestReadControlFrameSkipsHeartbeats(t *testing.T) {
+    var buf bytes.Buffer
+    WriteFrame(&buf, FrameHeartbeat, nil)
+    WriteFrame(&buf, FrameHeartbeat, nil)
+    WriteFrame(&buf, FrameListingEnd, []byte(`{"Files":1}`))
+
+    frameType, payload, err := ReadControlFrame(&buf)
+    if err != nil || frameType != FrameListingEnd || string(payload) != `{"Files":1}` {
+        t.Fatalf("got %q %q %v", frameType, payload, err)
+    }
+    if _, _, err := ReadControlFrame(&buf); err != io.EOF {
+        t.Fatalf("clean end: got %v, want io.EOF", err)
+    }
+}
+
+func TestReadControlFrameErrors(t *testing.T) {
+    var big bytes.Buffer
+    WriteFrame(&big, FrameHello, make([]byte, MaxControlFrame+1))
+    if _, _, err := ReadControlFrame(&big); err == nil {
+        t.Error("oversized frame accepted")
+    }
+
+    var cut bytes.Buffer
+    WriteFrame(&cut, FrameHello, []byte(`{"Hostname":"lab01"}`))
+    if _, _, err := ReadControlFrame(bytes.NewReader(cut.Bytes()[:cut.Len()-1])); err == nil {
+        t.Error("truncated payload accepted")
+    }
+    if _, _, err := ReadControlFrame(bytes.NewReader(cut.Bytes()[:3])); err == nil || err == io.EOF {
+        t.Errorf("truncated header: got %v", err)
+    }
+}
+
+func TestReadJSONFrameRejection(t *testing.T) {
+    var buf bytes.Buffer
+    WriteJSONFrame(&buf, FrameRejected, Rejection{Reason: "too many files"})
+    var ack FileAck
+    err := ReadJSONFrame(&buf, FrameFileAck, &ack)
+    if err == nil || !strings.Contains(err.Error(), "too many files") {
+        t.Fatalf("got %v, want the rejection reason", err)
+    }
+
+    buf.Reset()
+    WriteJSONFrame(&buf, FrameFileAck, FileAck{})
+    if err := ReadJSONFrame(&buf, FrameWelcome, &Welcome{}); err == nil {
+        t.Fatal("unexpected frame type accepted")
+    }
+}
+
+// sendFile writes content the way both ends do: data frames through a
+// ChunkWriter, compressed with encoding if set, then the trailer.
+func sendFile(t *testing.T, w io.Writer, content []byte, encoding string) {
+    t.Helper()
+    cw := &ChunkWriter{W: w}
+    var dst io.Writer = cw
+    var zw io.WriteCloser
+    if encoding != "" {
+        zw = Codecs[encoding].NewWriter(cw)
+        dst = zw
+    }
+    if _, err := dst.Write(content); err != nil {
+        t.Fatal(err)
+    }
+    if zw != nil {
+        if err := zw.Close(); err != nil {
+            t.Fatal(err)
+        }
+    }
+    sum := sha256.Sum256(content)
+    if err := WriteJSONFrame(w, FrameFileTrailer, FileTrailer{Size: cw.Written, SHA256: hex.EncodeToString(sum[:])}); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestChunkRoundTrip(t *testing.T) {
+    for _, size := range []int{0, 1, ChunkSize - 1, ChunkSize, ChunkSize + 1, 3*ChunkSize + 5} {
+        content := make([]byte, size)
+        for i := range content {
+            content[i] = byte(i * 7)
+        }
+        var buf bytes.Buffer
+        sendFile(t, &buf, content, "")
+
+        cr := &ChunkReader{R: &buf}
+        got, err := io.ReadAll(cr)
+        if err != nil {
+            t.Fatalf("size %d: %v", size, err)
+        }
+        if !bytes.Equal(got, content) {
+            t.Errorf("size %d: content differs", size)
+        }
+        sum := sha256.Sum256(content)
+        if cr.Received != int64(size) || cr.Trailer.Size != int64(size) || cr.Trailer.SHA256 != hex.EncodeToString(sum[:]) {
+            t.Errorf("size %d: received %d, trailer %+v", size, cr.Received, cr.Trailer)
+        }
+        if buf.Len() != 0 {
+            t.Errorf("size %d: %d bytes left after the trailer", size, buf.Len())
+        }
+    }
+}
+
+func TestChunkWriterFrameSize(t *testing.T) {
+    var buf bytes.Buffer
+    cw := &ChunkWriter{W: &buf}
+    cw.Write(make([]byte, 2*ChunkSize+1))
+    for _, want := range []uint32{ChunkSize, ChunkSize, 1} {
+        frameType, length, err := ReadFrameHeader(&buf)
+        if err != nil || frameType != FrameFileData || length != want {
+            t.Fatalf("got %q %d %v, want a data frame of %d", frameType, length, err, want)
+        }
+        buf.Next(int(length))
+    }
+}
+
+func TestChunkReaderErrors(t *testing.T) {
+    cases := map[string]func(w *bytes.Buffer){
+        "oversized data frame": func(w *bytes.Buffer) { WriteFrame(w, FrameFileData, make([]byte, ChunkSize+1)) },
+        "foreign frame":        func(w *bytes.Buffer) { WriteFrame(w, FrameHello, []byte("{}")) },
+        "bad trailer":          func(w *bytes.Buffer) { WriteFrame(w, FrameFileTrailer, []byte("{")) },
+        "no trailer":           func(w *bytes.Buffer) { WriteFrame(w, FrameFileData, []byte("abc")) },
+        "cut data frame":       func(w *bytes.Buffer) { w.Write([]byte{FrameFileData, 0, 0, 0, 9, 'a'}) },
+    }
+    for name, write := range cases {
+        var buf bytes.Buffer
+        write(&buf)
+        if _, err := io.ReadAll(&ChunkReader{R: &buf}); err == nil {
+            t.Errorf("%s: accepted", name)
+        }
+    }
+
+    var empty bytes.Buffer
+    if _, err := io.ReadAll(&ChunkReader{R: &empty}); !errors.Is(err, io.ErrUnexpectedEOF) {
+        t.Errorf("stream ending before the trailer: got %v, want io.ErrUnexpectedEOF", err)
+    }
+}
+
+func TestCodecsRoundTrip(t *testing.T) {
+    content := bytes.Repeat([]byte("int main() { return 0; }\n"), 5000)
+    for _, name := range CodecPreference {
+        c, ok := Codecs[name]
+        if !ok {
+            t.Fatalf("%s in CodecPreference but not in Codecs", name)
+        }
+
+        var buf bytes.Buffer
+        sendFile(t, &buf, content, name)
+        wire := &ChunkReader{R: &buf}
+        zr, err := c.NewReader(wire)
+        if err != nil {
+            t.Fatalf("%s: %v", name, err)
+        }
+        got, err := io.ReadAll(zr)
+        if err != nil {
+            t.Fatalf("%s: %v", name, err)
+        }
+        zr.Close()
+        if !bytes.Equal(got, content) {
+            t.Errorf("%s: content differs", name)
+        }
+        if wire.Received >= int64(len(content)) {
+            t.Errorf("%s: %d bytes on the wire for %d bytes of text", name, wire.Received, len(content))
+        }
+        io.Copy(io.Discard, wire)
+        if wire.Trailer.Size != wire.Received {
+            t.Errorf("%s: trailer says %d, received %d", name, wire.Trailer.Size, wire.Received)
+        }
+    }
+}
+
+func TestValidate(t *testing.T) {
+    valid := []FileHeader{
+        {RelativePath: "UAS/main.c", Size: 10},
+        {RelativePath: "UAS\\sub\\main.c", Size: 10, Offset: 10},
+        {RelativePath: "UAS", IsDir: true},
+        {RelativePath: "a..b/..c", Size: 1, Encoding: "gzip"},
+        {RelativePath: "main.c", Encoding: "deflate"},
+    }
+    invalid := []FileHeader{
+        {RelativePath: ""},
+        {RelativePath: "/etc/passwd"},
+        {RelativePath: "\\Windows\\win.ini"},
+        {RelativePath: ".."},
+        {RelativePath: "../x"},
+        {RelativePath: "..\\x"},
+        {RelativePath: "UAS/../../x"},
+        {RelativePath: "UAS/.."},
+        {RelativePath: "UAS/main.c", Size: -1},
+        {RelativePath: "UAS/main.c", Size: 10, Offset: 11},
+        {RelativePath: "UAS/main.c", Offset: -1},
+        {RelativePath: "UAS", IsDir: true, Size: 1},
+        {RelativePath: "UAS", IsDir: true, Encoding: "gzip"},
+        {RelativePath: "UAS/main.c", Encoding: "zstd"},
+    }
+    for _, h := range valid {
+        if err := h.Validate(); err != nil {
+            t.Errorf("%+v: %v", h, err)
+        }
+    }
+    for _, h := range invalid {
+        if err := h.Validate(); err == nil {
+            t.Errorf("%+v: accepted", h)
+        }
+    }
+}
+
+func TestPolicyTooDeep(t *testing.T) {
+    cases := []struct {
+        relPath  string
+        maxDepth int
+        tooDeep  bool
+    }{
+        {".", 1, false},
+        {"main.c", 1, false},
+        {"UAS/main.c", 1, true},
+        {"UAS/main.c", 2, false},
+        {"UAS/sub/main.c", 2, true},
+        {"UAS\\sub\\main.c", 2, true},
+        {"UAS\\sub\\main.c", 3, false},
+        {"UAS/sub/", 2, false},
+        {"a/b/c/d/e/f/g.c", 0, false},
+    }
+    for _, c := range cases {
+        if got := (Policy{MaxDepth: c.maxDepth}).TooDeep(c.relPath); got != c.tooDeep {
+            t.Errorf("TooDeep(%q) with depth %d = %v, want %v", c.relPath, c.maxDepth, got, c.tooDeep)
+        }
+    }
+}
+
+func TestHeartbeat(t *testing.T) {
+    var buf bytes.Buffer
+    hb := &Heartbeat{W: bufio.NewWriter(&buf)}
+    hb.Beat()
+    hb.Beat() // too soon, nothing sent
+    if buf.Len() != 5 {
+        t.Fatalf("got %d bytes, want one empty frame", buf.Len())
+    }
+    var none *Heartbeat
+    if err := none.Beat(); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func FuzzReadControlFrame(f *testing.F) {
+    for _, tc := range frameCases {
+        var buf bytes.Buffer
+        WriteJSONFrame(&buf, tc.frameType, tc.message)
+        f.Add(buf.Bytes())
+    }
+    f.Add([]byte{FrameHeartbeat, 0, 0, 0, 0})
+    f.Add([]byte{FrameHello, 0xff, 0xff, 0xff, 0xff})
+
+    f.Fuzz(func(t *testing.T, data []byte) {
+        frameType, payload, err := ReadControlFrame(bytes.NewReader(data))
+        if err != nil {
+            return
+        }
+        if frameType == FrameHeartbeat || len(payload) > MaxControlFrame {
+            t.Fatalf("returned frame %q with %d bytes", frameType, len(payload))
+        }
+        // Whatever is accepted reads back the same after writing it again
+        var buf bytes.Buffer
+        WriteFrame(&buf, frameType, payload)
+        again, repeated, err := ReadControlFrame(&buf)
+        if err != nil || again != frameType || !bytes.Equal(repeated, payload) {
+            t.Fatalf("round trip of %q changed: %q %v", frameType, repeated, err)
+        }
+    })
+}
+
+func FuzzChunkReader(f *testing.F) {
+    var buf bytes.Buffer
+    cw := &ChunkWriter{W: &buf}
+    cw.Write([]byte("int main() {}\n"))
+    WriteJSONFrame(&buf, FrameFileTrailer, FileTrailer{Size: cw.Written})
+    f.Add(buf.Bytes())
+    f.Add([]byte{FrameFileData, 0, 0, 0, 2, 'h', 'i'})
+    f.Add([]byte{FrameFileTrailer, 0, 0, 0, 2, '{', '}'})
+
+    f.Fuzz(func(t *testing.T, data []byte) {
+        cr := &ChunkReader{R: bytes.NewReader(data)}
+        n, err := io.Copy(io.Discard, cr)
+        if n != cr.Received {
+            t.Fatalf("read %d bytes, Received says %d", n, cr.Received)
+        }
+        if n > int64(len(data)) {
+            t.Fatalf("read %d bytes out of %d", n, len(data))
+        }
+        if err == nil {
+            // A clean end means the trailer was read and nothing more is returned
+            if m, err := cr.Read(make([]byte, 1)); m != 0 || err != io.EOF {
+                t.Fatalf("read after the trailer: %d %v", m, err)
+            }
+        }
+    })
+}
+
+func FuzzValidate(f *testing.F) {
+    f.Add("UAS/main.c", false, int64(10), int64(0), "")
+    f.Add("../x", false, int64(0), int64(0), "")
+    f.Add("UAS\\..\\..\\x", false, int64(1), int64(1), "gzip")
+    f.Add("UAS", true, int64(0), int64(0), "")
+
+    f.Fuzz(func(t *testing.T, relPath string, isDir bool, size, offset int64, encoding string) {
+        h := FileHeader{RelativePath: relPath, IsDir: isDir, Size: size, Offset: offset, Encoding: encoding}
+        if h.Validate() != nil {
+            return
+        }
+        // Accepted paths stay inside the submission folder however they are joined
+        p := strings.ReplaceAll(relPath, "\\", "/")
+        if clean := path.Clean(p); clean == ".." || strings.HasPrefix(clean, "../") || strings.HasPrefix(clean, "/") {
+            t.Fatalf("path %q accepted but cleans to %q", relPath, clean)
+        }
+        if size < 0 || offset < 0 || offset > size {
+            t.Fatalf("size %d at offset %d accepted", size, offset)
+        }
+        if _, ok := Codecs[encoding]; encoding != "" && !ok {
+            t.Fatalf("encoding %q accepted", encoding)
+        }
+    })
+}
\ No newline at end of file
@@ -0,0 +1,3 @@
+module labgo/s3
+
+go 1.21
\ No newline at end of file
@@ -0,0 +1,126 @@
+// Package s3 uploads files to an S3-compatible object store, such as the
+// campus MinIO, for the S3 archive mirror of server.go. Requests are signed with
+// AWS Signature Version 4 and use path-style URLs. Like the protocol it is
+// a module of its own so its tests run without the standalone programs:
+//
+//     cd s3 && go test ./...
+package s3
+
+import (
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "fmt"
+    "io"
+    "net/http"
+    "os"
+    "strings"
+    "time"
+)
+
+// Client uploads objects to one bucket.
+type Client struct {
+    Endpoint  string // scheme://host[:port]
+    Bucket    string
+    Region    string
+    Prefix    string // put in front of every key, ending in a slash
+    AccessKey string
+    SecretKey string
+    HTTP      *http.Client
+}
+
+// Put uploads file, whose SHA-256 and size are known, as key.
+func (c *Client) Put(key, file, sum string, size int64) error {
+    f, err := os.Open(file)
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+    // An empty file as body would be sent chunked, without the
+    // Content-Length object stores insist on
+    var body io.Reader = f
+    if size == 0 {
+        body = http.NoBody
+    }
+
+    req, err := http.NewRequest(http.MethodPut, c.Endpoint+"/"+c.Bucket+"/"+Escape(c.Prefix+key), body)
+    if err != nil {
+        return err
+    }
+    req.ContentLength = size
+    req.Header.Set("Content-Type", "application/octet-stream")
+    c.Sign(req, sum, time.Now())
+
+    client := c.HTTP
+    if client == nil {
+        client = http.DefaultClient
+    }
+    resp, err := client.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+        return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+    }
+    return nil
+}
+
+// Sign adds the AWS Signature Version 4 headers to req, whose body hashes
+// to payloadSum.
+func (c *Client) Sign(req *http.Request, payloadSum string, now time.Time) {
+    amzDate := now.UTC().Format("20060102T150405Z")
+    day := amzDate[:8]
+    req.Header.Set("X-Amz-Date", amzDate)
+    req.Header.Set("X-Amz-Content-Sha256", payloadSum)
+
+    const signedHeaders = "host;x-amz-content-sha256;x-amz-date"
+    canonical := strings.Join([]string{
+        req.Method,
+        req.URL.EscapedPath(),
+        req.URL.RawQuery,
+        "host:" + req.URL.Host,
+        "x-amz-content-sha256:" + payloadSum,
+        "x-amz-date:" + amzDate,
+        "",
+        signedHeaders,
+        payloadSum,
+    }, "\n")
+    canonicalSum := sha256.Sum256([]byte(canonical))
+
+    scope := day + "/" + c.Region + "/s3/aws4_request"
+    toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalSum[:])
+
+    key := []byte("AWS4" + c.SecretKey)
+    for _, part := range []string{day, c.Region, "s3", "aws4_request"} {
+        key = hmacSHA256(key, part)
+    }
+    signature := hex.EncodeToString(hmacSHA256(key, toSign))
+
+    req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+c.AccessKey+"/"+scope+
+        ", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+    mac := hmac.New(sha256.New, key)
+    mac.Write([]byte(data))
+    return mac.Sum(nil)
+}
+
+// Escape encodes an object key the way Signature Version 4 expects:
+// everything but letters, digits, - . _ ~ and the slashes between parts.
+func Escape(key string) string {
+    var b strings.Builder
+    for i := 0; i < len(key); i++ {
+        c := key[i]
+        switch {
+        case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z', c >= '0' && c <= '9',
+            c == '-', c == '.', c == '_', c == '~', c == '/':
+            b.WriteByte(c)
+        default:
+            fmt.Fprintf(&b, "%%%02X", c)
+        }
+    }
+    return b.String()
+}
\ No newline at end of file
@@ -1,142 +1,4620 @@
 package main
 
 import (
+    "archive/tar"
+    "archive/zip"
+    "bufio"
+    "bytes"
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "crypto/tls"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "encoding/csv"
+    "encoding/hex"
     "encoding/json"
+    "encoding/pem"
     "fmt"
+    "html"
+    "math/big"
+    "mime"
+    "mime/multipart"
+    "net/http"
+    "net/url"
+    "path"
 	"time"
     "io"
     "net"
     "os"
     "strings"
     "path/filepath"
+    "sort"
+    "strconv"
     "sync"
+    "unicode"
+
+    "labgo/protocol"
+    "labgo/s3"
+)
+
+const (
+    PORT = ":8080"
+    BASE_DIR = "received_files"
+    RECEIPTS_FILE = "receipts.log"
+    CERT_FILE = "lab_cert.pem"
+    KEY_FILE = "lab_key.pem"
+    REGISTRY_FILE = "enrolled_clients.json"
+    REJECTED_FILE = "rejected.log"
+    SUBMISSIONS_FILE = "submissions.log"
+    HELD_FILE = "held_files.json"
+    EVENTS_FILE = "client_events.log"
+    SUBMISSION_RECORD = "_submission.json"
+    LATEST_DIR = "latest"
+    HISTORY_DIR = "history"
+    BLOBS_DIR = "blobs"
+    TREE_FILE = "_tree.jsonl"
+)
+
+const (
+    serverVersion    = "5.2"
+    handshakeTimeout = 10 * time.Second
+    beaconInterval   = 2 * time.Second
+
+    resumeExpiry = 30 * time.Minute
+
+    // Clients reconnect every few seconds, so an enrolled machine's LastSeen
+    // is only written back to the registry once it is this much out of date
+    lastSeenInterval = 10 * time.Minute
+
+    // gc leaves unreferenced blobs this young alone, a running session may
+    // be about to refer to them
+    gcGrace = time.Hour
+
+    // A connection silent this long belongs to a generation 5 client, which
+    // waits for the patterns before it sends anything
+    legacyWait = 3 * time.Second
+
+    // Generation 1 and 4 clients open a connection per file. Connections from
+    // one address count as one session until none was open for this long
+    legacyRunGap = time.Minute
+
+    // First byte of a TLS handshake record
+    tlsHandshakeRecord = 0x16
+)
+
+// Older clients still installed on some lab images, told apart by how they
+// open a connection. They are accepted with --legacy.
+const (
+    legacyGen1 = "legacy-gen1" // "name|size\n" and the content, one file per connection
+    legacyGen3 = "legacy-gen3" // "hostname\n", then "name\nsize\n" and the content of every file
+    legacyGen4 = "legacy-gen4" // "ip|host|rel|abs\n" and the content until EOF, one file per connection
+    legacyGen5 = "legacy-gen5" // waits for a JSON pattern list, then streams JSON FileInfo objects
+)
+
+// Features this server can negotiate, offered to clients that announce them.
+var serverFeatures = []string{protocol.CapChunkedTransfer, protocol.CapServerPolicy, protocol.CapFileAck, protocol.CapResume, protocol.CapManifest, protocol.CapDeltaSync, protocol.CapFileEvents, protocol.CapHeartbeat, protocol.CapDistribution}
+
+// partialFile is a transfer cut off by a dropped connection. The bytes
+// received so far are kept in FullPath + ".part".
+type partialFile struct {
+    FullPath string
+    Size     int64
+    Offset   int64
+}
+
+// resumeRecord keeps the partial files of a session until the client
+// reconnects with its session ID or the record expires.
+type resumeRecord struct {
+    ClientKey string
+    Folder    string // submission folder, once the session stored a file
+    Partials  map[string]*partialFile
+    LastSeen  time.Time
+}
+
+var (
+    resumeMu  sync.Mutex
+    resumable = make(map[string]*resumeRecord)
+)
+
+// heldFile is the latest verified copy of a client file. Delta sync skips
+// files whose listed size, hash and modification time match it; a file that
+// was only saved again is still sent so its new edit time gets recorded.
+type heldFile struct {
+    IsDir    bool
+    Size     int64
+    ModTime  time.Time
+    SHA256   string
+    FullPath string
+}
+
+// Held copies by client key and relative path, kept in HELD_FILE so a
+// restarted server does not ask every client for everything again.
+var (
+    heldMu sync.Mutex
+    held   = make(map[string]map[string]heldFile)
+)
+
+// The starter files handed out to clients, loaded from Config.Distribute
+// at startup. Files changed afterwards fail the clients' hash check until
+// the server is restarted.
+var distribution protocol.Distribution
+
+// The archive mirror picked with --mirror at startup, nil for none.
+var mirror Mirror
+
+// The session name announced with --name, recorded in every snapshot so an
+// export can pick one exam.
+var sessionName string
+
+// Open connections, counted against Config.MaxConns and MaxConnsPerIP.
+var (
+    connsMu   sync.Mutex
+    conns     int
+    connsByIP = make(map[string]int)
+)
+
+// Guard appends to the logs shared by all client goroutines.
+var (
+    receiptsMu sync.Mutex
+    submissionsMu sync.Mutex
+    eventsMu sync.Mutex
+    rejectedMu sync.Mutex
+    registryMu sync.Mutex
+)
+
+// EnrolledClient is a lab PC that paired with the server. MachineID is
+// generated by the client on first run and stays stable when the hostname
+// or IP address changes.
+type EnrolledClient struct {
+    MachineID  string
+    Hostname   string
+    Key        string
+    EnrolledAt time.Time
+    LastSeen   time.Time
+    Revoked    bool
+    RevokedAt  time.Time
+}
+
+// PairingCode lets UsesLeft machines enroll until it expires. A code with
+// Replace set only enrolls that machine again, replacing its key and
+// lifting a revocation; other codes never touch an enrolled machine.
+type PairingCode struct {
+    Code     string
+    Expires  time.Time
+    UsesLeft int
+    Replace  string `json:",omitempty"` // machine ID
+}
+
+// Registry is the server's list of enrolled machines, kept in
+// REGISTRY_FILE so the maintenance commands can edit it while the server
+// runs.
+type Registry struct {
+    Clients      map[string]*EnrolledClient
+    PairingCodes []*PairingCode
+}
+
+// Maintenance commands, run as ./server <command> [args] instead of serving.
+var commands = map[string]func(args []string) error{
+    "gen-cert": genCert,
+    "pair":     pairCommand,
+    "clients":  clientsCommand,
+    "revoke":   revokeCommand,
+
+    "snapshots": snapshotsCommand,
+    "restore":   restoreCommand,
+    "prune":     pruneCommand,
+
+    "fsck":        fsckCommand,
+    "gc":          gcCommand,
+    "materialize": materializeCommand,
+    "export":      exportCommand,
+}
+
+// Config holds the server command line.
+type Config struct {
+    Patterns []string
+    Policy   protocol.Policy
+    CertFile string
+    KeyFile  string
+    NoTLS    bool
+
+    RegistryFile string
+    NoAuth       bool
+    Legacy       bool // also accept the unauthenticated plaintext clients of older lab images
+
+    Codecs []string // compression codecs offered to clients
+
+    ReadTimeout  time.Duration // longest wait for the rest of a transfer
+    WriteTimeout time.Duration
+    IdleTimeout  time.Duration // longest wait for the next file or message
+
+    Limits        protocol.Limits
+    MaxConns      int // concurrent connections overall, 0 = unlimited
+    MaxConnsPerIP int
+
+    Name      string // session name announced in beacons
+    Advertise string // address announced in beacons, empty for the sender address
+    NoBeacon  bool
+
+    // Address of the HTTP upload endpoint, empty (the default) to disable
+    // it. Browsers cannot hold an enrollment key, so these uploads are not
+    // authenticated and --http is the proctor's explicit opt-in to that.
+    HTTPAddr string
+
+    Distribute string // folder of starter files handed out to clients
+    Target     string // folder the clients put them in, inside their search path
+
+    Mirror         string // archive mirror of the submissions: tar, s3 or empty for none
+    MirrorEndpoint string
+    MirrorBucket   string
+    MirrorRegion   string
+    MirrorPrefix   string
+}
+
+func parseArgs(args []string) Config {
+    config := Config{
+        Policy:   protocol.Policy{MaxDepth: 5},
+        CertFile: CERT_FILE,
+        KeyFile:  KEY_FILE,
+        RegistryFile: REGISTRY_FILE,
+        Codecs:       protocol.CodecPreference,
+        ReadTimeout:  60 * time.Second,
+        WriteTimeout: 60 * time.Second,
+        IdleTimeout:  2 * time.Minute,
+        Limits: protocol.Limits{
+            MaxFileSize:     256 << 20,
+            MaxFiles:        10000,
+            MaxSessionBytes: 2 << 30,
+        },
+        MaxConns:      200,
+        MaxConnsPerIP: 4,
+        MirrorRegion:  "us-east-1",
+    }
+
+    for i := 0; i < len(args); i++ {
+        arg := args[i]
+        switch {
+        case arg == "--help" || arg == "-h":
+            printHelp()
+            os.Exit(0)
+        case arg == "--file":
+            config.Policy.MatchFiles = true
+        case arg == "--folder":
+            config.Policy.MatchFolders = true
+        case arg == "--allow-override":
+            config.Policy.AllowOverride = true
+        case arg == "--ext":
+            config.Policy.Extensions = parseExtensions(flagValue(args, &i))
+        case arg == "--depth":
+            config.Policy.MaxDepth = flagInt(args, &i)
+        case arg == "--cert":
+            config.CertFile = flagValue(args, &i)
+        case arg == "--key":
+            config.KeyFile = flagValue(args, &i)
+        case arg == "--no-tls":
+            config.NoTLS = true
+        case arg == "--registry":
+            config.RegistryFile = flagValue(args, &i)
+        case arg == "--no-auth":
+            config.NoAuth = true
+        case arg == "--legacy":
+            config.Legacy = true
+        case arg == "--compression":
+            value := flagValue(args, &i)
+            config.Codecs = nil
+            if value == "none" {
+                continue
+            }
+            for _, name := range strings.Split(value, ",") {
+                if _, ok := protocol.Codecs[name]; !ok {
+                    fmt.Printf("Error: unknown codec %q (known: %v)\n", name, protocol.CodecPreference)
+                    os.Exit(1)
+                }
+                config.Codecs = append(config.Codecs, name)
+            }
+        case arg == "--read-timeout":
+            config.ReadTimeout = flagDuration(args, &i)
+        case arg == "--write-timeout":
+            config.WriteTimeout = flagDuration(args, &i)
+        case arg == "--idle-timeout":
+            config.IdleTimeout = flagDuration(args, &i)
+        case arg == "--max-file-size":
+            config.Limits.MaxFileSize = flagSize(args, &i)
+        case arg == "--max-files":
+            config.Limits.MaxFiles = flagInt(args, &i)
+        case arg == "--max-session-bytes":
+            config.Limits.MaxSessionBytes = flagSize(args, &i)
+        case arg == "--max-conns":
+            config.MaxConns = flagInt(args, &i)
+        case arg == "--max-conns-per-ip":
+            config.MaxConnsPerIP = flagInt(args, &i)
+        case arg == "--name":
+            config.Name = flagValue(args, &i)
+        case arg == "--advertise":
+            config.Advertise = flagValue(args, &i)
+        case arg == "--no-beacon":
+            config.NoBeacon = true
+        case arg == "--http":
+            config.HTTPAddr = flagValue(args, &i)
+        case arg == "--distribute":
+            config.Distribute = flagValue(args, &i)
+        case arg == "--target":
+            config.Target = flagValue(args, &i)
+        case arg == "--mirror":
+            config.Mirror = flagValue(args, &i)
+        case arg == "--mirror-endpoint":
+            config.MirrorEndpoint = flagValue(args, &i)
+        case arg == "--mirror-bucket":
+            config.MirrorBucket = flagValue(args, &i)
+        case arg == "--mirror-region":
+            config.MirrorRegion = flagValue(args, &i)
+        case arg == "--mirror-prefix":
+            config.MirrorPrefix = flagValue(args, &i)
+        case strings.HasPrefix(arg, "--"):
+            fmt.Printf("Unknown flag: %s\n", arg)
+            os.Exit(1)
+        default:
+            config.Patterns = append(config.Patterns, arg)
+        }
+    }
+
+    if len(config.Patterns) == 0 {
+        printHelp()
+        os.Exit(1)
+    }
+
+    if config.Name == "" {
+        config.Name, _ = os.Hostname()
+    }
+    if config.Distribute != "" && config.Target == "" {
+        abs, _ := filepath.Abs(config.Distribute)
+        config.Target = filepath.Base(abs)
+    }
+
+    // Without explicit flags collect both matching files and folders
+    if !config.Policy.MatchFiles && !config.Policy.MatchFolders {
+        config.Policy.MatchFiles = true
+        config.Policy.MatchFolders = true
+    }
+
+    return config
+}
+
+// flagValue returns the value following the flag at args[*i] and moves i
+// past it.
+func flagValue(args []string, i *int) string {
+    if *i+1 >= len(args) {
+        fmt.Printf("Error: %s needs a value\n", args[*i])
+        os.Exit(1)
+    }
+    *i++
+    return args[*i]
+}
+
+func flagInt(args []string, i *int) int {
+    flag := args[*i]
+    value := flagValue(args, i)
+    n, err := strconv.Atoi(value)
+    if err != nil || n < 0 {
+        fmt.Printf("Error: invalid %s %q\n", flag, value)
+        os.Exit(1)
+    }
+    return n
+}
+
+// parseExtensions turns "cpp,.py, c" into [".cpp" ".py" ".c"].
+func parseExtensions(list string) []string {
+    var exts []string
+    for _, ext := range strings.Split(list, ",") {
+        ext = strings.ToLower(strings.TrimSpace(ext))
+        if ext == "" {
+            continue
+        }
+        if !strings.HasPrefix(ext, ".") {
+            ext = "." + ext
+        }
+        exts = append(exts, ext)
+    }
+    return exts
+}
+
+func flagDuration(args []string, i *int) time.Duration {
+    flag := args[*i]
+    value := flagValue(args, i)
+    d, err := time.ParseDuration(value)
+    if err != nil || d < 0 {
+        fmt.Printf("Error: invalid %s %q (e.g. 30s, 5m)\n", flag, value)
+        os.Exit(1)
+    }
+    return d
+}
+// flagSize reads a byte count with an optional K, M or G suffix.
+func flagSize(args []string, i *int) int64 {
+    flag := args[*i]
+    value := flagValue(args, i)
+    number, shift := strings.ToUpper(value), uint(0)
+    switch {
+    case strings.HasSuffix(number, "K"):
+        shift = 10
+    case strings.HasSuffix(number, "M"):
+        shift = 20
+    case strings.HasSuffix(number, "G"):
+        shift = 30
+    }
+    if shift > 0 {
+        number = number[:len(number)-1]
+    }
+    n, err := strconv.ParseInt(number, 10, 64)
+    if err != nil || n < 0 {
+        fmt.Printf("Error: invalid %s %q (e.g. 500K, 100M, 2G)\n", flag, value)
+        os.Exit(1)
+    }
+    return n << shift
+}
+func printHelp() {
+    fmt.Println(`Usage: ./server [FLAGS] <pattern1> <pattern2> ...
+
+Collection policy (pushed to every client):
+    --file            Collect files whose name matches a pattern
+    --folder          Collect everything inside folders matching a pattern
+                      (default: both --file and --folder)
+    --ext LIST        Only collect these extensions, e.g. .cpp,.py,.c
+    --depth N         Maximum folder depth searched on clients (default: 5, 0 = unlimited)
+    --allow-override  Let clients override the policy with their own flags
+
+Transport:
+    --cert FILE       Lab certificate (default: lab_cert.pem)
+    --key FILE        Lab certificate key (default: lab_key.pem)
+    --no-tls          Accept plaintext connections instead of TLS
+    --registry FILE   Enrolled machines (default: enrolled_clients.json)
+    --no-auth         Accept clients without authentication
+    --legacy          Also accept the old clients of lab images not upgraded yet
+                      (Name|Size, hostname stream, ip|host|rel|abs and JSON FileInfo),
+                      in cleartext and without authentication
+    --compression L   Codecs clients may use, e.g. gzip,deflate or none (default: gzip,deflate)
+    --read-timeout D  Drop a client stalling in the middle of a file (default: 60s, 0 = never)
+    --write-timeout D Drop a client that stops reading (default: 60s, 0 = never)
+    --idle-timeout D  Drop a client silent between files (default: 2m, 0 = never)
+
+Limits (0 = unlimited):
+    --max-file-size S       Largest single file, e.g. 100M (default: 256M)
+    --max-files N           Files per session (default: 10000)
+    --max-session-bytes S   Bytes per session (default: 2G)
+    --max-conns N           Concurrent connections (default: 200)
+    --max-conns-per-ip N    Concurrent connections from one address (default: 4)
+
+Discovery:
+    --name NAME       Session name clients pick with --session (default: hostname)
+    --advertise IP    Address announced to clients (default: the one beacons are sent from)
+    --no-beacon       Do not announce the server on the LAN
+
+Uploads without the client:
+    --http ADDR       Also accept uploads from a browser or curl on ADDR, e.g. :8443
+                      (HTTPS with the lab certificate unless --no-tls). Off by
+                      default: these uploads skip enrollment, anyone who reaches
+                      ADDR can submit under any name
+
+Exam start:
+    --distribute DIR  Hand out the files in DIR (soal, starter code) to every client
+    --target NAME     Folder the clients put them in, inside their search path,
+                      e.g. UAS_2024_KelasA (default: the name of DIR). Files the
+                      student already has there are never overwritten
+
+Archive mirror:
+    Submissions are always kept in received_files, and a file is acknowledged
+    once it is stored there. A mirror gets a copy of every verified file
+    afterwards; when copying fails the error is logged and the client is not
+    told, the copy in received_files stays the one that counts.
+    --mirror KIND           Copy submissions to (default: no mirror):
+                              tar  one growing HOST_IP_TIMESTAMP.tar per session
+                              s3   an S3-compatible object store (MinIO, Ceph, AWS)
+    --mirror-endpoint URL   Object store, e.g. https://s3.kampus.ac.id or http://127.0.0.1:9000
+    --mirror-bucket NAME    Bucket the submissions go to
+    --mirror-region NAME    Region to sign requests for (default: us-east-1)
+    --mirror-prefix P       Key prefix inside the bucket, e.g. 2024/UAS/
+                            The keys come from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY
+    --help, -h        Show this help message
+
+Commands:
+    ./server gen-cert [--cert FILE] [--key FILE] [--host NAMES] [--days N] [--force]
+                      Create the self-signed lab certificate
+    ./server pair [--uses N] [--ttl MINUTES] [--registry FILE] [--replace MACHINE_ID|HOSTNAME]
+                      Show a one-time pairing code for enrolling lab PCs. Machines
+                      already enrolled or revoked need a code made with --replace
+    ./server clients [--registry FILE]
+                      List enrolled machines and when they were last seen (to
+                      within 10 minutes)
+    ./server revoke <MACHINE_ID|HOSTNAME> [--registry FILE]
+                      Revoke a machine's key
+    ./server snapshots [CLIENT]
+                      List the clients with a history, or the snapshots of CLIENT (HOST_IP)
+    ./server restore <CLIENT> <SNAPSHOT|last> <DIR>
+                      Copy one snapshot of a client out as a plain folder tree
+    ./server prune [--keep-first N] [--keep-last N] [--dry-run] [CLIENT]
+                      After the exam: keep the first N and last N snapshots of
+                      every client (or only CLIENT) and delete versions no longer used
+    ./server fsck
+                      Check that every stored blob is intact and nothing refers to a missing one
+    ./server gc [--dry-run]
+                      Delete blobs no submission, snapshot or held file refers to
+    ./server materialize [--out DIR] [--link] [CLIENT]
+                      Lay the submissions out as HOST_IP_TIMESTAMP/relative/path again
+                      (default: inside received_files, copies with the students' edit
+                      times; --link hard-links the read-only blobs instead)
+    ./server export [--out DIR] [--roster FILE] [--session NAME] [--since TIME] [--until TIME]
+                      After the exam: one zip per class with every student's last
+                      submission and a manifest.json (default: into export/). Classes
+                      come from the roster, a CSV of client,student,class lines, or
+                      else from the student's Kelas folder. --session only takes the
+                      submissions made while the server ran with --name NAME. TIME
+                      is e.g. "2024-06-10 08:00"
+
+Examples:
+    ./server gen-cert
+    ./server pair --uses 40 --ttl 15
+    ./server "Struktur Data"
+    ./server --folder --ext .cpp,.py,.c UAS_2024
+    ./server --file --depth 3 --allow-override tugas
+    ./server --name UAS_StrukturData_KelasA UAS_2024
+    ./server export --session UAS_StrukturData_KelasA --roster roster.csv
+    ./server --distribute soal_uas --target UAS_2024_KelasA UAS_2024_KelasA
+    ./server --mirror s3 --mirror-endpoint http://10.0.0.5:9000 --mirror-bucket ujian --mirror-prefix 2024/UAS/ UAS_2024`)
+}
+
+// genCert creates the self-signed certificate the lab server presents.
+// Clients pin it, so no CA or network access is involved.
+func genCert(args []string) error {
+    certFile, keyFile := CERT_FILE, KEY_FILE
+    days := 5 * 365
+    force := false
+    var hosts []string
+
+    for i := 0; i < len(args); i++ {
+        switch args[i] {
+        case "--cert":
+            certFile = flagValue(args, &i)
+        case "--key":
+            keyFile = flagValue(args, &i)
+        case "--days":
+            days = flagInt(args, &i)
+        case "--host":
+            hosts = strings.Split(flagValue(args, &i), ",")
+        case "--force":
+            force = true
+        default:
+            return fmt.Errorf("unknown gen-cert argument: %s", args[i])
+        }
+    }
+
+    if !force {
+        for _, path := range []string{certFile, keyFile} {
+            if _, err := os.Stat(path); err == nil {
+                return fmt.Errorf("%s already exists (use --force to replace it)", path)
+            }
+        }
+    }
+
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        return fmt.Errorf("error generating key: %v", err)
+    }
+    serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+    if err != nil {
+        return fmt.Errorf("error generating serial: %v", err)
+    }
+
+    template := x509.Certificate{
+        SerialNumber: serial,
+        Subject:      pkix.Name{CommonName: "LAB-GO collector", Organization: []string{"LAB-GO"}},
+        NotBefore:    time.Now().Add(-time.Hour),
+        NotAfter:     time.Now().AddDate(0, 0, days),
+        KeyUsage:     x509.KeyUsageDigitalSignature,
+        ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+    }
+    for _, host := range hosts {
+        host = strings.TrimSpace(host)
+        if ip := net.ParseIP(host); ip != nil {
+            template.IPAddresses = append(template.IPAddresses, ip)
+        } else if host != "" {
+            template.DNSNames = append(template.DNSNames, host)
+        }
+    }
+
+    der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+    if err != nil {
+        return fmt.Errorf("error creating certificate: %v", err)
+    }
+    keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+    if err != nil {
+        return fmt.Errorf("error encoding key: %v", err)
+    }
+
+    certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+    keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+    if err := os.WriteFile(certFile, certPEM, 0644); err != nil {
+        return err
+    }
+    if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+        return err
+    }
+
+    fmt.Printf("Wrote %s and %s (valid %d days)\n", certFile, keyFile, days)
+    fmt.Printf("Fingerprint: %s\n", certFingerprint(der))
+    fmt.Printf("Copy %s next to every client executable, or start clients with --pin %s\n", certFile, certFingerprint(der))
+    return nil
+}
+
+func loadRegistry(path string) (*Registry, error) {
+    registry := &Registry{Clients: make(map[string]*EnrolledClient)}
+    data, err := os.ReadFile(path)
+    if os.IsNotExist(err) {
+        return registry, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    if err := json.Unmarshal(data, registry); err != nil {
+        return nil, fmt.Errorf("%s: %v", path, err)
+    }
+    if registry.Clients == nil {
+        registry.Clients = make(map[string]*EnrolledClient)
+    }
+    return registry, nil
+}
+
+// updateRegistry loads the registry, applies fn and writes it back unless
+// fn fails.
+func updateRegistry(path string, fn func(*Registry) error) error {
+    registryMu.Lock()
+    defer registryMu.Unlock()
+
+    registry, err := loadRegistry(path)
+    if err != nil {
+        return err
+    }
+    if err := fn(registry); err != nil {
+        return err
+    }
+
+    data, err := json.MarshalIndent(registry, "", "  ")
+    if err != nil {
+        return err
+    }
+    tmp := path + ".tmp"
+    if err := os.WriteFile(tmp, data, 0600); err != nil {
+        return err
+    }
+    return os.Rename(tmp, path)
+}
+
+func normalizePairingCode(code string) string {
+    code = strings.ReplaceAll(code, "-", "")
+    return strings.ReplaceAll(code, " ", "")
+}
+
+// pairCommand creates a pairing code and shows it on the proctor console.
+func pairCommand(args []string) error {
+    registryFile := REGISTRY_FILE
+    uses, ttl := 1, 15
+    replace := ""
+    for i := 0; i < len(args); i++ {
+        switch args[i] {
+        case "--registry":
+            registryFile = flagValue(args, &i)
+        case "--uses":
+            uses = flagInt(args, &i)
+        case "--ttl":
+            ttl = flagInt(args, &i)
+        case "--replace":
+            replace = flagValue(args, &i)
+        default:
+            return fmt.Errorf("unknown pair argument: %s", args[i])
+        }
+    }
+    if uses < 1 {
+        return fmt.Errorf("--uses must be at least 1")
+    }
+    if replace != "" && uses != 1 {
+        return fmt.Errorf("--replace is for one machine, drop --uses")
+    }
+
+    n, err := rand.Int(rand.Reader, big.NewInt(100000000))
+    if err != nil {
+        return err
+    }
+    code := fmt.Sprintf("%08d", n.Int64())
+    expires := time.Now().Add(time.Duration(ttl) * time.Minute)
+
+    var replaced *EnrolledClient
+    err = updateRegistry(registryFile, func(registry *Registry) error {
+        if replace != "" {
+            replaced = registry.Clients[replace]
+            if replaced == nil {
+                var matches []*EnrolledClient
+                for _, c := range registry.Clients {
+                    if strings.EqualFold(c.Hostname, replace) {
+                        matches = append(matches, c)
+                    }
+                }
+                if len(matches) > 1 {
+                    return fmt.Errorf("hostname %q matches several machines, use the machine ID (see ./server clients)", replace)
+                }
+                if len(matches) == 0 {
+                    return fmt.Errorf("no enrolled machine %q", replace)
+                }
+                replaced = matches[0]
+            }
+        }
+
+        // Drop used up and expired codes while we are here
+        var codes []*PairingCode
+        for _, pc := range registry.PairingCodes {
+            if pc.UsesLeft > 0 && time.Now().Before(pc.Expires) {
+                codes = append(codes, pc)
+            }
+        }
+        pc := &PairingCode{Code: code, Expires: expires, UsesLeft: uses}
+        if replaced != nil {
+            pc.Replace = replaced.MachineID
+        }
+        registry.PairingCodes = append(codes, pc)
+        return nil
+    })
+    if err != nil {
+        return err
+    }
+
+    fmt.Printf("\n    Pairing code: %s-%s\n\n", code[:4], code[4:])
+    if replaced != nil {
+        fmt.Printf("Only re-enrolls %s (%s), replacing its key", replaced.MachineID, replaced.Hostname)
+        if replaced.Revoked {
+            fmt.Printf(" and lifting its revocation")
+        }
+        fmt.Printf(".\n")
+    }
+    fmt.Printf("Valid for %d enrollment(s) until %s.\n", uses, expires.Format("15:04"))
+    fmt.Printf("On the lab PC run: client <SERVER_IP> --enroll %s-%s\n", code[:4], code[4:])
+    return nil
+}
+
+func clientsCommand(args []string) error {
+    registryFile := REGISTRY_FILE
+    for i := 0; i < len(args); i++ {
+        switch args[i] {
+        case "--registry":
+            registryFile = flagValue(args, &i)
+        default:
+            return fmt.Errorf("unknown clients argument: %s", args[i])
+        }
+    }
+
+    registry, err := loadRegistry(registryFile)
+    if err != nil {
+        return err
+    }
+    ids := make([]string, 0, len(registry.Clients))
+    for id := range registry.Clients {
+        ids = append(ids, id)
+    }
+    sort.Strings(ids)
+
+    fmt.Printf("%-32s  %-20s  %-16s  %-16s  %s\n", "MACHINE ID", "HOSTNAME", "ENROLLED", "LAST SEEN", "STATUS")
+    for _, id := range ids {
+        c := registry.Clients[id]
+        status := "active"
+        if c.Revoked {
+            status = "revoked " + c.RevokedAt.Format("2006-01-02 15:04")
+        }
+        lastSeen := "-"
+        if !c.LastSeen.IsZero() {
+            lastSeen = c.LastSeen.Format("2006-01-02 15:04")
+        }
+        fmt.Printf("%-32s  %-20s  %-16s  %-16s  %s\n", id, c.Hostname, c.EnrolledAt.Format("2006-01-02 15:04"), lastSeen, status)
+    }
+    return nil
+}
+
+// revokeCommand revokes one machine, named by its ID or hostname. The
+// running server rereads the registry for every connection, so the
+// revocation applies immediately.
+func revokeCommand(args []string) error {
+    registryFile := REGISTRY_FILE
+    target := ""
+    for i := 0; i < len(args); i++ {
+        switch {
+        case args[i] == "--registry":
+            registryFile = flagValue(args, &i)
+        case target == "":
+            target = args[i]
+        default:
+            return fmt.Errorf("unknown revoke argument: %s", args[i])
+        }
+    }
+    if target == "" {
+        return fmt.Errorf("usage: ./server revoke <MACHINE_ID|HOSTNAME>")
+    }
+
+    return updateRegistry(registryFile, func(registry *Registry) error {
+        var matches []*EnrolledClient
+        if c, ok := registry.Clients[target]; ok {
+            matches = append(matches, c)
+        } else {
+            for _, c := range registry.Clients {
+                if strings.EqualFold(c.Hostname, target) && !c.Revoked {
+                    matches = append(matches, c)
+                }
+            }
+        }
+        if len(matches) == 0 {
+            return fmt.Errorf("no enrolled machine %q", target)
+        }
+        if len(matches) > 1 {
+            var ids []string
+            for _, c := range matches {
+                ids = append(ids, c.MachineID)
+            }
+            return fmt.Errorf("hostname %q matches several machines, revoke by ID: %s", target, strings.Join(ids, ", "))
+        }
+
+        matches[0].Revoked = true
+        matches[0].RevokedAt = time.Now()
+        fmt.Printf("Revoked %s (%s)\n", matches[0].MachineID, matches[0].Hostname)
+        return nil
+    })
+}
+
+// enrollClient redeems a pairing code and registers the machine with a
+// fresh key, which is returned to the client in Welcome.
+func enrollClient(registryFile string, hello protocol.Hello) (string, error) {
+    if hello.MachineID == "" {
+        return "", fmt.Errorf("enrollment without machine ID")
+    }
+
+    keyBytes := make([]byte, 32)
+    if _, err := rand.Read(keyBytes); err != nil {
+        return "", err
+    }
+    key := hex.EncodeToString(keyBytes)
+
+    err := updateRegistry(registryFile, func(registry *Registry) error {
+        code := normalizePairingCode(hello.PairingCode)
+        var match *PairingCode
+        for _, pc := range registry.PairingCodes {
+            if hmac.Equal([]byte(pc.Code), []byte(code)) && pc.UsesLeft > 0 && time.Now().Before(pc.Expires) {
+                match = pc
+            }
+        }
+        if match == nil {
+            return fmt.Errorf("invalid or expired pairing code")
+        }
+        // A plain code could otherwise swap the key of a working machine or
+        // bring a revoked image back
+        existing, enrolled := registry.Clients[hello.MachineID]
+        switch {
+        case match.Replace != "" && match.Replace != hello.MachineID:
+            return fmt.Errorf("pairing code is for re-enrolling another machine")
+        case enrolled && existing.Revoked && match.Replace == "":
+            return fmt.Errorf("machine revoked; re-enrolling it takes a code from ./server pair --replace %s", hello.MachineID)
+        case enrolled && match.Replace == "":
+            return fmt.Errorf("machine already enrolled; re-enrolling it takes a code from ./server pair --replace %s", hello.MachineID)
+        }
+        match.UsesLeft--
+
+        registry.Clients[hello.MachineID] = &EnrolledClient{
+            MachineID:  hello.MachineID,
+            Hostname:   hello.Hostname,
+            Key:        key,
+            EnrolledAt: time.Now(),
+            LastSeen:   time.Now(),
+        }
+        return nil
+    })
+    if err != nil {
+        return "", err
+    }
+    return key, nil
+}
+
+// authenticate looks the machine up in the registry and runs the
+// challenge-response exchange with its key. It returns the hostname the
+// machine was enrolled with, which names its folders whatever it claims now.
+func authenticate(reader *bufio.Reader, writer *bufio.Writer, hello protocol.Hello, registryFile string) (string, error) {
+    registryMu.Lock()
+    registry, err := loadRegistry(registryFile)
+    registryMu.Unlock()
+    if err != nil {
+        return "", fmt.Errorf("error loading registry: %v", err)
+    }
+
+    client, ok := registry.Clients[hello.MachineID]
+    if !ok || hello.MachineID == "" {
+        return "", fmt.Errorf("machine not enrolled")
+    }
+    if client.Revoked {
+        return "", fmt.Errorf("machine revoked")
+    }
+    key, err := hex.DecodeString(client.Key)
+    if err != nil {
+        return "", fmt.Errorf("corrupt key in registry: %v", err)
+    }
+
+    nonce := make([]byte, 32)
+    if _, err := rand.Read(nonce); err != nil {
+        return "", fmt.Errorf("error generating challenge: %v", err)
+    }
+    challenge := protocol.Challenge{Nonce: hex.EncodeToString(nonce)}
+    if err := protocol.WriteJSONFrame(writer, protocol.FrameChallenge, challenge); err != nil {
+        return "", fmt.Errorf("error sending challenge: %v", err)
+    }
+    if err := writer.Flush(); err != nil {
+        return "", fmt.Errorf("error sending challenge: %v", err)
+    }
+
+    var response protocol.AuthResponse
+    if err := protocol.ReadJSONFrame(reader, protocol.FrameAuth, &response); err != nil {
+        return "", fmt.Errorf("no valid auth response: %v", err)
+    }
+    expected := protocol.AuthMAC(key, challenge.Nonce, hello)
+    if !hmac.Equal([]byte(response.MAC), []byte(expected)) {
+        return "", fmt.Errorf("wrong auth response")
+    }
+
+    if time.Since(client.LastSeen) >= lastSeenInterval {
+        err := updateRegistry(registryFile, func(registry *Registry) error {
+            if c, ok := registry.Clients[hello.MachineID]; ok {
+                c.LastSeen = time.Now()
+            }
+            return nil
+        })
+        if err != nil {
+            fmt.Printf("Error recording that machine %s was seen: %v\n", hello.MachineID, err)
+        }
+    }
+    if client.Hostname == "" {
+        return hello.Hostname, nil
+    }
+    return client.Hostname, nil
+}
+
+// logRejected records a connection refused during the handshake.
+func logRejected(clientAddr string, hello protocol.Hello, reason string) {
+    fmt.Printf("REJECTED %s (machine %s, host %q, ip %s): %s\n", clientAddr, hello.MachineID, hello.Hostname, hello.ClientIP, reason)
+
+    rejectedMu.Lock()
+    defer rejectedMu.Unlock()
+
+    f, err := os.OpenFile(filepath.Join(BASE_DIR, REJECTED_FILE), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+    if err != nil {
+        fmt.Printf("Error writing rejected log: %v\n", err)
+        return
+    }
+    defer f.Close()
+
+    fmt.Fprintf(f, "%s addr=%s machine=%s host=%q ip=%s agent=%q reason=%q\n",
+        time.Now().Format("2006-01-02 15:04:05"), clientAddr, hello.MachineID, hello.Hostname, hello.ClientIP, hello.AgentVersion, reason)
+}
+
+func certFingerprint(der []byte) string {
+    sum := sha256.Sum256(der)
+    return hex.EncodeToString(sum[:])
+}
+
+// listen opens the collector port. TLS is not started by the listener:
+// handleClient looks at the first bytes to tell TLS clients from legacy
+// ones, and the returned config is nil when TLS is disabled.
+func listen(config Config) (net.Listener, *tls.Config, error) {
+    var tlsConfig *tls.Config
+    if config.NoTLS {
+        fmt.Println("WARNING: TLS disabled, submissions travel in cleartext")
+    } else {
+        cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+        if err != nil {
+            return nil, nil, fmt.Errorf("error loading lab certificate: %v (create one with ./server gen-cert, or use --no-tls)", err)
+        }
+        fmt.Printf("TLS certificate fingerprint: %s\n", certFingerprint(cert.Certificate[0]))
+        tlsConfig = &tls.Config{
+            Certificates: []tls.Certificate{cert},
+            MinVersion:   tls.VersionTLS12,
+        }
+    }
+
+    listener, err := net.Listen("tcp", PORT)
+    if err != nil {
+        return nil, nil, err
+    }
+    return listener, tlsConfig, nil
+}
+
+const uploadForm = `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>LAB-GO submission</title></head>
+<body>
+<h1>Submit your files</h1>
+<p>Accepted: %s</p>
+<form method="post" action="/upload" enctype="multipart/form-data">
+<p><label>Name / NIM: <input name="name" required></label></p>
+<p><label>Files: <input type="file" name="files" multiple></label></p>
+<p><label>Or a whole folder: <input type="file" name="files" webkitdirectory></label></p>
+<p><button type="submit">Upload</button></p>
+</form>
+</body>
+</html>`
+
+// serveHTTP accepts uploads from browsers and laptops without the client.
+// Files go through saveFile like TCP submissions and have to match the same
+// patterns and policy.
+func serveHTTP(config Config) {
+    mux := http.NewServeMux()
+    mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+        if r.URL.Path != "/" {
+            http.NotFound(w, r)
+            return
+        }
+        w.Header().Set("Content-Type", "text/html; charset=utf-8")
+        fmt.Fprintf(w, uploadForm, html.EscapeString(strings.Join(config.Patterns, ", ")))
+    })
+    mux.HandleFunc("/upload", func(w http.ResponseWriter, r *http.Request) {
+        handleUpload(w, r, config)
+    })
+
+    server := &http.Server{
+        Addr:              config.HTTPAddr,
+        Handler:           mux,
+        ReadHeaderTimeout: handshakeTimeout,
+        IdleTimeout:       config.IdleTimeout,
+    }
+    var err error
+    if config.NoTLS {
+        err = server.ListenAndServe()
+    } else {
+        err = server.ListenAndServeTLS(config.CertFile, config.KeyFile)
+    }
+    fmt.Printf("HTTP upload endpoint stopped: %v\n", err)
+}
+
+// handleUpload stores one multipart upload as a session of its own. The
+// name field stands in for the hostname and has to come before the files.
+// Nothing ties it to an enrolled machine, see Config.HTTPAddr.
+func handleUpload(w http.ResponseWriter, r *http.Request, config Config) {
+    if r.Method != http.MethodPost {
+        http.Redirect(w, r, "/", http.StatusSeeOther)
+        return
+    }
+
+    remoteIP, _, _ := net.SplitHostPort(r.RemoteAddr)
+    if refused := acquireConnection(remoteIP, config); refused != "" {
+        http.Error(w, refused, http.StatusServiceUnavailable)
+        return
+    }
+    defer releaseConnection(remoteIP)
+
+    if config.Limits.MaxSessionBytes > 0 {
+        r.Body = http.MaxBytesReader(w, r.Body, config.Limits.MaxSessionBytes+1<<20)
+    }
+    mr, err := r.MultipartReader()
+    if err != nil {
+        http.Error(w, "expected a multipart/form-data upload", http.StatusBadRequest)
+        return
+    }
+
+    session := &Session{
+        ID:           newSessionID(),
+        ClientIP:     remoteIP,
+        AgentVersion: "http",
+        Started:      time.Now(),
+        Stored:       make(map[string]string),
+        Counted:      make(map[string]int64),
+    }
+    defer closeSubmission(session)
+    var acks []protocol.FileAck
+    for {
+        part, err := mr.NextPart()
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            http.Error(w, "error reading upload: "+err.Error(), http.StatusBadRequest)
+            return
+        }
+
+        relPath := uploadPath(part)
+        if relPath == "" {
+            if part.FormName() == "name" {
+                name, _ := io.ReadAll(io.LimitReader(part, 128))
+                session.Hostname = sanitizeName(string(name))
+            }
+            continue
+        }
+        if session.Hostname == "" {
+            http.Error(w, "the name field is missing or comes after the files", http.StatusBadRequest)
+            return
+        }
+
+        ack, err := receiveUpload(session, part, relPath, config)
+        if limitErr, ok := err.(*limitError); ok {
+            logRejected(r.RemoteAddr, protocol.Hello{Hostname: session.Hostname, ClientIP: remoteIP, AgentVersion: "http"}, limitErr.reason)
+            http.Error(w, "rejected: "+limitErr.reason, http.StatusRequestEntityTooLarge)
+            return
+        }
+        if ack.OK {
+            fmt.Printf("Received upload from %s (%s): %s\n", remoteIP, session.Hostname, relPath)
+        } else {
+            fmt.Printf("Refused upload from %s (%s): %s: %s\n", remoteIP, session.Hostname, relPath, ack.Error)
+        }
+        acks = append(acks, ack)
+    }
+    if session.Hostname == "" {
+        http.Error(w, "the name field is missing", http.StatusBadRequest)
+        return
+    }
+
+    status := protocol.SubmissionStatus{Status: protocol.StatusComplete, Files: len(acks)}
+    for _, ack := range acks {
+        if !ack.OK {
+            status.Status = protocol.StatusIncomplete
+            status.Missing = append(status.Missing, ack.RelativePath)
+        }
+    }
+    session.Status = status.Status
+    writeSubmission(session, status, "http upload")
+
+    w.Header().Set("Content-Type", "text/html; charset=utf-8")
+    fmt.Fprintf(w, "<!DOCTYPE html>\n<html><head><meta charset=\"utf-8\"><title>LAB-GO submission</title></head><body>\n")
+    fmt.Fprintf(w, "<h1>Submission %s</h1>\n<ul>\n", status.Status)
+    for _, ack := range acks {
+        if ack.OK {
+            fmt.Fprintf(w, "<li>%s: stored, sha256 %s</li>\n", html.EscapeString(ack.RelativePath), ack.SHA256)
+        } else {
+            fmt.Fprintf(w, "<li>%s: <b>%s</b></li>\n", html.EscapeString(ack.RelativePath), html.EscapeString(ack.Error))
+        }
+    }
+    fmt.Fprintf(w, "</ul>\n<p><a href=\"/\">Upload more</a></p>\n</body></html>\n")
+}
+
+// receiveUpload checks one uploaded file against the policy and stores it.
+func receiveUpload(session *Session, part io.Reader, relPath string, config Config) (protocol.FileAck, error) {
+    if !policyAllows(config, relPath) {
+        return protocol.FileAck{RelativePath: relPath, Error: "does not match the accepted patterns"}, nil
+    }
+    return receivePlain(session, protocol.FileHeader{RelativePath: relPath}, part, config.Limits)
+}
+
+// receivePlain is receiveFile for content that arrives without frames, from
+// an HTTP upload or a legacy client: the limits are checked and the content
+// is stored with saveFile, which hashes it.
+func receivePlain(session *Session, header protocol.FileHeader, data io.Reader, limits protocol.Limits) (protocol.FileAck, error) {
+    relPath := header.RelativePath
+    ack := protocol.FileAck{RelativePath: relPath}
+
+    allowed, reason, err := checkLimits(session, header, limits)
+    if err != nil {
+        return ack, err
+    }
+    body := data
+    var raw *limitReader
+    if allowed >= 0 {
+        raw = &limitReader{r: data, n: allowed, reason: reason}
+        body = raw
+    }
+    if err := header.Validate(); err != nil {
+        ack.Error = err.Error()
+        return ack, nil
+    }
+
+    saved, err := saveFile(session, header, body)
+    if raw != nil {
+        session.BytesReceived += allowed - raw.n
+        session.Counted[relPath] += allowed - raw.n
+        if raw.n < 0 {
+            return ack, &limitError{reason: reason}
+        }
+    }
+    if err != nil {
+        ack.Error = err.Error()
+        return ack, nil
+    }
+
+    ack.OK = true
+    ack.SHA256 = saved.SHA256
+    session.Stored[relPath] = saved.Path
+    updateLatest(session, relPath, saved.Path, false, header.ModTime)
+    recordTree(session, header, saved.SHA256, saved.Size)
+    writeReceipt(session, header, saved.Path, saved.Size, saved.SHA256)
+    return ack, nil
+}
+
+// uploadPath returns the file name of an upload part with the folders a
+// folder upload sends along, which Part.FileName strips. It is cleaned so
+// it cannot climb out of the submission folder.
+func uploadPath(part *multipart.Part) string {
+    _, params, err := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+    if err != nil {
+        return ""
+    }
+    name := strings.ReplaceAll(params["filename"], "\\", "/")
+    return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// policyAllows applies the collection policy the clients follow to a path
+// uploaded over HTTP.
+func policyAllows(config Config, relPath string) bool {
+    policy := config.Policy
+    parts := strings.Split(relPath, "/")
+    if policy.TooDeep(relPath) {
+        return false
+    }
+    if len(policy.Extensions) > 0 && !protocol.IsValidExtension(relPath, policy.Extensions) {
+        return false
+    }
+    if policy.MatchFiles && protocol.ContainsPattern(parts[len(parts)-1], config.Patterns) {
+        return true
+    }
+    if policy.MatchFolders {
+        for _, dir := range parts[:len(parts)-1] {
+            if protocol.ContainsPattern(dir, config.Patterns) {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+// sanitizeName keeps the name typed into the upload form usable as part of
+// a folder name.
+func sanitizeName(name string) string {
+    return strings.Map(func(r rune) rune {
+        if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-' || r == '_' || r == ' ' {
+            return r
+        }
+        return '_'
+    }, strings.TrimSpace(name))
+}
+
+// announce broadcasts a Beacon every beaconInterval, to the limited
+// broadcast address and to the broadcast address of every local IPv4
+// network, since the former only leaves through one interface on some
+// systems.
+func announce(config Config) {
+    port, _ := strconv.Atoi(strings.TrimPrefix(PORT, ":"))
+    payload, _ := json.Marshal(protocol.Beacon{
+        Magic:         protocol.BeaconMagic,
+        Name:          config.Name,
+        Address:       config.Advertise,
+        Port:          port,
+        ServerVersion: serverVersion,
+    })
+
+    pc, err := net.ListenPacket("udp4", ":0")
+    if err != nil {
+        fmt.Printf("Error starting beacon: %v\n", err)
+        return
+    }
+    defer pc.Close()
+
+    for {
+        for _, ip := range broadcastAddrs() {
+            pc.WriteTo(payload, &net.UDPAddr{IP: ip, Port: protocol.DISCOVERY_PORT})
+        }
+        time.Sleep(beaconInterval)
+    }
+}
+
+func broadcastAddrs() []net.IP {
+    addrs := []net.IP{net.IPv4bcast}
+    ifaces, err := net.Interfaces()
+    if err != nil {
+        return addrs
+    }
+    for _, iface := range ifaces {
+        if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagBroadcast == 0 {
+            continue
+        }
+        ifaceAddrs, err := iface.Addrs()
+        if err != nil {
+            continue
+        }
+        for _, addr := range ifaceAddrs {
+            ipnet, ok := addr.(*net.IPNet)
+            if !ok || ipnet.IP.To4() == nil {
+                continue
+            }
+            ip := ipnet.IP.To4()
+            mask := net.IP(ipnet.Mask).To4()
+            if mask == nil {
+                continue
+            }
+            bcast := make(net.IP, 4)
+            for i := range bcast {
+                bcast[i] = ip[i] | ^mask[i]
+            }
+            addrs = append(addrs, bcast)
+        }
+    }
+    return addrs
+}
+
+// Session is the server side of one client connection after the handshake.
+type Session struct {
+    ID           string
+    MachineID    string
+    Hostname     string
+    ClientIP     string
+    ClientKey    string // MachineID, or hostname and IP for clients without one
+    AgentVersion string
+    Features     []string
+    Resumed      bool
+    Started      time.Time
+
+    // Every file of the session goes into Folder, named after the client and
+    // Started and created when the first file arrives
+    Folder string
+
+    Stored   map[string]string // relative path -> full path of verified files
+    Manifest []protocol.ManifestEntry
+    Status   string // set once the manifest has been reconciled
+    Listing  []protocol.ListingEntry
+
+    Heartbeat *protocol.Heartbeat // nil unless the client supports heartbeats
+
+    Files         int   // files received, counted against Limits
+    BytesReceived int64 // file content received, counted against Limits
+
+    // Content bytes counted per relative path, so a file sent again after a
+    // nack or to resume it counts once
+    Counted map[string]int64
+}
+
+// SubmissionRecord is kept as SUBMISSION_RECORD in every submission folder,
+// so a folder can be understood without the logs.
+type SubmissionRecord struct {
+    SessionID    string
+    MachineID    string
+    Hostname     string
+    ClientIP     string
+    AgentVersion string
+    Started      time.Time
+    Ended        time.Time // zero while the client is connected
+    Status       string    // empty until the client's manifest is reconciled
+    Files        []string  // relative paths stored in the folder
+}
+
+func main() {
+    if len(os.Args) > 1 {
+        if command, ok := commands[os.Args[1]]; ok {
+            if err := command(os.Args[2:]); err != nil {
+                fmt.Printf("Error: %v\n", err)
+                os.Exit(1)
+            }
+            return
+        }
+    }
+
+    config := parseArgs(os.Args[1:])
+
+    if config.NoAuth {
+        fmt.Println("WARNING: authentication disabled, any machine can submit files")
+    } else if config.NoTLS {
+        fmt.Println("WARNING: enrollment keys are sent in cleartext without TLS")
+    }
+    if config.Legacy {
+        fmt.Println("WARNING: legacy clients are accepted in cleartext without authentication")
+    }
+    
+    // Create base directory
+    if err := os.MkdirAll(BASE_DIR, 0755); err != nil {
+        fmt.Printf("Error creating base directory: %v\n", err)
+        return
+    }
+    if err := loadHeld(); err != nil {
+        fmt.Printf("Error loading held files: %v\n", err)
+        return
+    }
+    sessionName = config.Name
+    var err error
+    if mirror, err = newMirror(config); err != nil {
+        fmt.Printf("Error setting up the archive mirror: %v\n", err)
+        return
+    }
+    switch config.Mirror {
+    case "tar":
+        fmt.Printf("Mirroring every session into a tar file in %s\n", BASE_DIR)
+    case "s3":
+        fmt.Printf("Mirroring submissions to %s/%s/%s\n", config.MirrorEndpoint, config.MirrorBucket, config.MirrorPrefix)
+    }
+    if config.Distribute != "" {
+        dist, err := loadDistribution(config.Distribute, config.Target)
+        if err != nil {
+            fmt.Printf("Error loading starter files: %v\n", err)
+            return
+        }
+        distribution = dist
+        fmt.Printf("Distributing %d starter files from %s into %q on the clients\n", len(dist.Files), config.Distribute, dist.Target)
+    }
+
+    // Start TCP server
+    listener, tlsConfig, err := listen(config)
+    if err != nil {
+        fmt.Printf("Error starting server: %v\n", err)
+        return
+    }
+    defer listener.Close()
+
+    policy := config.Policy
+    fmt.Printf("Server listening on %s\nAccepted patterns: %v\n", PORT, config.Patterns)
+    fmt.Printf("Collection policy: files=%v folders=%v extensions=%v depth=%d override=%v\n",
+        policy.MatchFiles, policy.MatchFolders, policy.Extensions, policy.MaxDepth, policy.AllowOverride)
+
+    if config.HTTPAddr != "" {
+        go serveHTTP(config)
+        scheme := "https"
+        if config.NoTLS {
+            scheme = "http"
+        }
+        fmt.Printf("Accepting uploads on %s://%s/ without authentication (--http)\n", scheme, config.HTTPAddr)
+    }
+
+    if !config.NoBeacon {
+        go announce(config)
+        fmt.Printf("Announcing session %q on UDP port %d\n", config.Name, protocol.DISCOVERY_PORT)
+    }
+
+    var wg sync.WaitGroup
+    for {
+        conn, err := listener.Accept()
+        if err != nil {
+            fmt.Printf("Error accepting connection: %v\n", err)
+            continue
+        }
+
+        wg.Add(1)
+        go handleClient(conn, config, tlsConfig, &wg)
+    }
+}
+
+func handleClient(conn net.Conn, config Config, tlsConfig *tls.Config, wg *sync.WaitGroup) {
+    // conn is replaced by the TLS connection once it is known to be one
+    defer func() { conn.Close() }()
+    defer wg.Done()
+
+    clientAddr := conn.RemoteAddr().String()
+    fmt.Printf("New connection from: %s\n", clientAddr)
+
+    // Over the limit the client still gets a Welcome explaining why
+    remoteIP, _, _ := net.SplitHostPort(clientAddr)
+    refused := acquireConnection(remoteIP, config)
+    if refused == "" {
+        defer releaseConnection(remoteIP)
+    }
+
+    sniffed, generation, err := sniffClient(conn, config, tlsConfig)
+    if err != nil {
+        fmt.Printf("Handshake with %s failed: %v\n", clientAddr, err)
+        return
+    }
+    conn = sniffed
+    if generation != "" {
+        // Legacy clients cannot be told why, they only see the connection close
+        if refused != "" {
+            logRejected(clientAddr, protocol.Hello{ClientIP: remoteIP, AgentVersion: generation}, refused)
+            fmt.Printf("Legacy client %s refused: %s\n", clientAddr, refused)
+            return
+        }
+        handleLegacyClient(conn, generation, config)
+        return
+    }
+
+    // The handshake sets its own deadline, the read timeouts start after it
+    dc := &protocol.DeadlineConn{Conn: conn, WriteTimeout: config.WriteTimeout}
+    reader := bufio.NewReader(dc)
+    writer := bufio.NewWriter(dc)
+
+    // Handshake, sends patterns to client
+    session, err := acceptSession(dc, reader, writer, config, refused)
+    if err != nil {
+        fmt.Printf("Handshake with %s failed: %v\n", clientAddr, err)
+        return
+    }
+    if protocol.HasFeature(session.Features, protocol.CapHeartbeat) {
+        session.Heartbeat = &protocol.Heartbeat{W: writer, Last: time.Now()}
+    }
+
+    reason := "aborted"
+    defer func() {
+        fmt.Printf("Client %s disconnected: %s\n", clientAddr, reason)
+        writeEvent(session, "disconnected", "", reason)
+    }()
+    fmt.Printf("Session %s: %s (%s), machine %s, agent %s, features %v\n",
+        session.ID, session.Hostname, session.ClientIP, session.MachineID, session.AgentVersion, session.Features)
+
+    defer closeSubmission(session)
+
+    // Without a manifest there is no telling a finished client from one that
+    // died halfway, so such sessions are recorded as incomplete
+    defer func() {
+        if protocol.HasFeature(session.Features, protocol.CapManifest) && session.Status == "" {
+            session.Status = protocol.StatusIncomplete
+            writeSubmission(session, protocol.SubmissionStatus{Status: protocol.StatusIncomplete}, "session ended without manifest")
+        }
+    }()
+    defer func() {
+        if len(session.Stored) > 0 {
+            if err := saveHeld(); err != nil {
+                fmt.Printf("Error saving held files: %v\n", err)
+            }
+        }
+    }()
+
+    // Receive files
+    for {
+        dc.ReadTimeout = config.IdleTimeout
+        frameType, payload, err := protocol.ReadControlFrame(reader)
+        dc.ReadTimeout = config.ReadTimeout
+        if err == io.EOF {
+            // Clean end of session, nothing left to resume
+            forgetResumable(session.ID)
+            reason = "session finished"
+            break
+        }
+        if err != nil {
+            reason = disconnectReason(err, config.IdleTimeout)
+            fmt.Printf("Error receiving file from %s: %v\n", clientAddr, err)
+            return
+        }
+
+        if frameType == protocol.FrameResumeQuery {
+            var query protocol.ResumeQuery
+            if err := json.Unmarshal(payload, &query); err != nil {
+                fmt.Printf("Invalid resume query from %s: %v\n", clientAddr, err)
+                return
+            }
+            query.RelativePath = slashPath(query.RelativePath)
+            reply := resumeOffset(session, query)
+            if reply.Offset > 0 {
+                fmt.Printf("Resuming %s from %s at byte %d\n", query.RelativePath, clientAddr, reply.Offset)
+            }
+            if err := protocol.WriteJSONFrame(writer, protocol.FrameResumeReply, reply); err != nil {
+                fmt.Printf("Error sending resume offset to %s: %v\n", clientAddr, err)
+                return
+            }
+            if err := writer.Flush(); err != nil {
+                fmt.Printf("Error sending resume offset to %s: %v\n", clientAddr, err)
+                return
+            }
+            continue
+        }
+        if frameType == protocol.FrameListing {
+            var entry protocol.ListingEntry
+            if err := json.Unmarshal(payload, &entry); err != nil {
+                fmt.Printf("Invalid listing from %s: %v\n", clientAddr, err)
+                return
+            }
+            entry.RelativePath = slashPath(entry.RelativePath)
+            session.Listing = append(session.Listing, entry)
+            continue
+        }
+        if frameType == protocol.FrameListingEnd {
+            var end protocol.ListingEnd
+            if err := json.Unmarshal(payload, &end); err != nil {
+                fmt.Printf("Invalid listing from %s: %v\n", clientAddr, err)
+                return
+            }
+            wanted := wantedFiles(session)
+            fmt.Printf("Listing from %s: %d files, %d changed\n", clientAddr, len(session.Listing), len(wanted.Indexes))
+            // The listing is everything the client has, so what it no longer
+            // lists is gone, also when the client restarted since sending it
+            if end.Files == len(session.Listing) {
+                for _, relPath := range missingHeld(session) {
+                    recordDeletion(session, clientAddr, relPath)
+                }
+            }
+            session.Listing = nil
+
+            if err := protocol.WriteJSONFrame(writer, protocol.FrameWanted, wanted); err != nil {
+                fmt.Printf("Error sending wanted files to %s: %v\n", clientAddr, err)
+                return
+            }
+            if err := writer.Flush(); err != nil {
+                fmt.Printf("Error sending wanted files to %s: %v\n", clientAddr, err)
+                return
+            }
+            continue
+        }
+        if frameType == protocol.FrameDelete {
+            var del protocol.FileDelete
+            if err := json.Unmarshal(payload, &del); err != nil {
+                fmt.Printf("Invalid delete record from %s: %v\n", clientAddr, err)
+                return
+            }
+            recordDeletion(session, clientAddr, slashPath(del.RelativePath))
+            continue
+        }
+        if frameType == protocol.FrameDistRequest {
+            var wanted protocol.WantedFiles
+            if err := json.Unmarshal(payload, &wanted); err != nil {
+                fmt.Printf("Invalid starter file request from %s: %v\n", clientAddr, err)
+                return
+            }
+            if err := sendDistribution(session, writer, config.Distribute, wanted); err != nil {
+                reason = disconnectReason(err, config.WriteTimeout)
+                fmt.Printf("Error sending starter files to %s: %v\n", clientAddr, err)
+                return
+            }
+            fmt.Printf("Sent %d starter files to %s\n", len(wanted.Indexes), clientAddr)
+            continue
+        }
+        if frameType == protocol.FrameClientError {
+            var clientErr protocol.ClientError
+            if err := json.Unmarshal(payload, &clientErr); err != nil {
+                fmt.Printf("Invalid error report from %s: %v\n", clientAddr, err)
+                return
+            }
+            clientErr.RelativePath = slashPath(clientErr.RelativePath)
+            fmt.Printf("Error on client %s: %s: %s\n", clientAddr, clientErr.RelativePath, clientErr.Error)
+            writeEvent(session, "error", clientErr.RelativePath, clientErr.Error)
+            continue
+        }
+        if frameType == protocol.FrameManifest {
+            var entry protocol.ManifestEntry
+            if err := json.Unmarshal(payload, &entry); err != nil {
+                fmt.Printf("Invalid manifest from %s: %v\n", clientAddr, err)
+                return
+            }
+            entry.RelativePath = slashPath(entry.RelativePath)
+            session.Manifest = append(session.Manifest, entry)
+            continue
+        }
+        if frameType == protocol.FrameManifestEnd {
+            var end protocol.ManifestEnd
+            if err := json.Unmarshal(payload, &end); err != nil {
+                fmt.Printf("Invalid manifest from %s: %v\n", clientAddr, err)
+                return
+            }
+            status, err := reconcile(session, end)
+            if err != nil {
+                reason = disconnectReason(err, config.WriteTimeout)
+                fmt.Printf("Error checking the submission of %s against its manifest: %v\n", clientAddr, err)
+                return
+            }
+            session.Status = status.Status
+            session.Manifest = nil
+            writeSubmission(session, status, "")
+            fmt.Printf("Submission from %s is %s: %d files, %d missing, %d corrupt\n",
+                clientAddr, status.Status, status.Files, len(status.Missing), len(status.Corrupt))
+
+            if err := protocol.WriteJSONFrame(writer, protocol.FrameSubmission, status); err != nil {
+                fmt.Printf("Error sending submission status to %s: %v\n", clientAddr, err)
+                return
+            }
+            if err := writer.Flush(); err != nil {
+                fmt.Printf("Error sending submission status to %s: %v\n", clientAddr, err)
+                return
+            }
+            continue
+        }
+        if frameType != protocol.FrameFileHeader {
+            fmt.Printf("Error receiving file from %s: unexpected frame %q\n", clientAddr, frameType)
+            return
+        }
+
+        var header protocol.FileHeader
+        if err := json.Unmarshal(payload, &header); err != nil {
+            fmt.Printf("Invalid file header from %s: %v\n", clientAddr, err)
+            return
+        }
+        header.RelativePath = slashPath(header.RelativePath)
+
+        ack, err := receiveFile(session, reader, header, config.Limits)
+        if limitErr, ok := err.(*limitError); ok {
+            reason = "rejected: " + limitErr.reason
+            rejectClient(session, dc, writer, limitErr.reason)
+            return
+        }
+        if err != nil {
+            reason = disconnectReason(err, config.ReadTimeout)
+            fmt.Printf("Error receiving file from %s: %v\n", clientAddr, err)
+            return
+        }
+
+        if ack.OK {
+            fmt.Printf("Received file from %s: %s\n", clientAddr, header.RelativePath)
+        } else {
+            fmt.Printf("Error saving file from %s: %s: %s\n", clientAddr, header.RelativePath, ack.Error)
+        }
+
+        if protocol.HasFeature(session.Features, protocol.CapFileAck) {
+            if err := protocol.WriteJSONFrame(writer, protocol.FrameFileAck, ack); err != nil {
+                fmt.Printf("Error sending ack to %s: %v\n", clientAddr, err)
+                return
+            }
+            if err := writer.Flush(); err != nil {
+                fmt.Printf("Error sending ack to %s: %v\n", clientAddr, err)
+                return
+            }
+        }
+    }
+}
+
+// receiveFile stores the transfer announced by header and verifies it.
+// Problems with the file itself end up in the returned ack; an error means
+// the stream is broken and the connection has to be dropped.
+func receiveFile(session *Session, reader *bufio.Reader, header protocol.FileHeader, limits protocol.Limits) (protocol.FileAck, error) {
+    ack := protocol.FileAck{RelativePath: header.RelativePath}
+
+    allowed, reason, err := checkLimits(session, header, limits)
+    if err != nil {
+        return ack, err
+    }
+
+    data := &protocol.ChunkReader{R: reader}
+    var wire io.Reader = data
+    var raw *limitReader
+    if allowed >= 0 {
+        // Compression adds a little, anything beyond that is not a real file
+        wire = &limitReader{r: data, n: allowed + allowed/100 + protocol.ChunkSize, reason: reason}
+    }
+
+    var body io.Reader = wire
+    var saved savedFile
+    var saveErr error
+    if header.Encoding != "" {
+        if c, ok := protocol.Codecs[header.Encoding]; !ok {
+            saveErr = fmt.Errorf("unknown encoding %q", header.Encoding)
+        } else if zr, err := c.NewReader(wire); err != nil {
+            saveErr = fmt.Errorf("error decompressing file: %v", err)
+        } else {
+            defer zr.Close()
+            body = zr
+        }
+    }
+    if allowed >= 0 {
+        raw = &limitReader{r: body, n: allowed, reason: reason}
+        body = raw
+    }
+    if saveErr == nil {
+        saveErr = header.Validate()
+    }
+    if saveErr == nil {
+        saved, saveErr = saveFile(session, header, body)
+    }
+    if raw != nil {
+        session.BytesReceived += allowed - raw.n
+        session.Counted[header.RelativePath] += allowed - raw.n
+        if raw.n < 0 {
+            return ack, &limitError{reason: reason}
+        }
+    }
+
+    // Drain whatever saveFile did not consume so the next header lines up
+    if _, err := io.Copy(io.Discard, wire); err != nil {
+        return ack, err
+    }
+
+    // A failed retry must not leave an earlier copy counted as stored
+    delete(session.Stored, header.RelativePath)
+
+    if saveErr != nil {
+        ack.Error = saveErr.Error()
+        return ack, nil
+    }
+    if data.Trailer.Size != data.Received {
+        ack.Error = fmt.Sprintf("trailer says %d bytes, got %d", data.Trailer.Size, data.Received)
+        return ack, nil
+    }
+    if header.IsDir {
+        ack.OK = true
+        session.Stored[header.RelativePath] = saved.Path
+        setHeld(session.ClientKey, header.RelativePath, heldFile{IsDir: true, FullPath: saved.Path})
+        updateLatest(session, header.RelativePath, saved.Path, true, header.ModTime)
+        recordTree(session, header, "", 0)
+        return ack, nil
+    }
+
+    // saveFile hashed what actually landed on disk, not what went through
+    // memory
+    sum, size := saved.SHA256, saved.Size
+    ack.SHA256 = sum
+    // The blob is named after what arrived, so it is not wrong in itself and
+    // may be shared; without a tree entry gc collects it
+    if data.Trailer.SHA256 != "" && sum != data.Trailer.SHA256 {
+        ack.Error = fmt.Sprintf("sha256 mismatch: client sent %s, stored %s", data.Trailer.SHA256, sum)
+        return ack, nil
+    }
+
+    ack.OK = true
+    session.Stored[header.RelativePath] = saved.Path
+    setHeld(session.ClientKey, header.RelativePath, heldFile{Size: size, ModTime: header.ModTime, SHA256: sum, FullPath: saved.Path})
+    updateLatest(session, header.RelativePath, saved.Path, false, header.ModTime)
+    recordTree(session, header, sum, size)
+    writeReceipt(session, header, saved.Path, size, sum)
+    return ack, nil
+}
+
+// loadDistribution lists and hashes the starter files in dir. The list
+// travels in Welcome, so it has to fit a control frame.
+func loadDistribution(dir, target string) (protocol.Distribution, error) {
+    dist := protocol.Distribution{Target: target}
+    err := filepath.Walk(dir, func(fullPath string, info os.FileInfo, err error) error {
+        if err != nil {
+            return err
+        }
+        relPath, err := filepath.Rel(dir, fullPath)
+        if err != nil || relPath == "." {
+            return err
+        }
+        file := protocol.DistFile{RelativePath: filepath.ToSlash(relPath), IsDir: info.IsDir()}
+        if !file.IsDir {
+            if file.SHA256, file.Size, err = hashFile(fullPath); err != nil {
+                return err
+            }
+        }
+        dist.Files = append(dist.Files, file)
+        return nil
+    })
+    if err != nil {
+        return dist, err
+    }
+    if b, _ := json.Marshal(dist); len(b) > protocol.MaxControlFrame/2 {
+        return dist, fmt.Errorf("%s has too many files to announce (%d)", dir, len(dist.Files))
+    }
+    return dist, nil
+}
+
+// sendDistribution streams the requested starter files in the order asked.
+// The trailer carries the hash of what was actually read, so a file edited
+// on the server since startup fails the client's check instead of passing
+// for the announced version.
+func sendDistribution(session *Session, writer *bufio.Writer, dir string, wanted protocol.WantedFiles) error {
+    for _, i := range wanted.Indexes {
+        if i < 0 || i >= len(distribution.Files) || distribution.Files[i].IsDir {
+            return fmt.Errorf("invalid starter file index %d", i)
+        }
+        file := distribution.Files[i]
+        if err := sendDistFile(writer, file, filepath.Join(dir, filepath.FromSlash(file.RelativePath))); err != nil {
+            return err
+        }
+        writeEvent(session, "distributed", file.RelativePath, "")
+    }
+    return writer.Flush()
+}
+
+// sendDistFile sends one starter file as header, data frames and trailer.
+// A file that cannot be read goes out empty with no hash in the trailer,
+// which the client reports instead of saving.
+func sendDistFile(w *bufio.Writer, file protocol.DistFile, fullPath string) error {
+    header := protocol.FileHeader{RelativePath: file.RelativePath}
+    f, err := os.Open(fullPath)
+    var info os.FileInfo
+    if err == nil {
+        defer f.Close()
+        info, err = f.Stat()
+    }
+    if err != nil {
+        fmt.Printf("Error reading starter file %s: %v\n", fullPath, err)
+        f = nil
+    } else {
+        header.Size = info.Size()
+        header.ModTime = info.ModTime()
+        header.Mode = info.Mode().Perm()
+    }
+
+    if err := protocol.WriteJSONFrame(w, protocol.FrameFileHeader, header); err != nil {
+        return err
+    }
+    cw := &protocol.ChunkWriter{W: w}
+    trailer := protocol.FileTrailer{}
+    if f != nil {
+        h := sha256.New()
+        if _, err := io.Copy(cw, io.TeeReader(f, h)); err != nil {
+            return err
+        }
+        trailer.SHA256 = hex.EncodeToString(h.Sum(nil))
+    }
+    trailer.Size = cw.Written
+    return protocol.WriteJSONFrame(w, protocol.FrameFileTrailer, trailer)
+}
+
+// wantedFiles picks the listed files the server does not hold yet. Held
+// copies that are skipped count as stored in this session, so the manifest
+// still reconciles as complete.
+func wantedFiles(session *Session) protocol.WantedFiles {
+    heldMu.Lock()
+    defer heldMu.Unlock()
+
+    var wanted protocol.WantedFiles
+    for i, entry := range session.Listing {
+        kept, ok := held[session.ClientKey][entry.RelativePath]
+        if ok && kept.IsDir == entry.IsDir && kept.Size == entry.Size && kept.SHA256 == entry.SHA256 &&
+            (entry.IsDir || entry.SHA256 != "" && kept.ModTime.Equal(entry.ModTime)) {
+            if info, err := os.Stat(kept.FullPath); err == nil && (entry.IsDir || info.Size() == entry.Size) {
+                session.Stored[entry.RelativePath] = kept.FullPath
+                continue
+            }
+        }
+        wanted.Indexes = append(wanted.Indexes, i)
+    }
+    return wanted
+}
+
+// missingHeld lists the held copies of the session's client that its
+// listing lacks, deepest paths first so folders come after their files.
+func missingHeld(session *Session) []string {
+    heldMu.Lock()
+    defer heldMu.Unlock()
+
+    listed := make(map[string]bool, len(session.Listing))
+    for _, entry := range session.Listing {
+        listed[entry.RelativePath] = true
+    }
+    var missing []string
+    for relPath := range held[session.ClientKey] {
+        if !listed[relPath] {
+            missing = append(missing, relPath)
+        }
+    }
+    sort.Sort(sort.Reverse(sort.StringSlice(missing)))
+    return missing
+}
+
+// recordDeletion handles a file or folder gone from the client, reported by
+// it or missing from its listing. The stored copies stay; it is no longer
+// held or in the latest view.
+func recordDeletion(session *Session, clientAddr, relPath string) {
+    fmt.Printf("Client %s deleted %s\n", clientAddr, relPath)
+    delete(session.Stored, relPath)
+    dropHeld(session.ClientKey, relPath)
+    dropLatest(session, relPath)
+    writeEvent(session, "deleted", relPath, "")
+}
+
+func setHeld(clientKey, relPath string, kept heldFile) {
+    heldMu.Lock()
+    defer heldMu.Unlock()
+
+    if held[clientKey] == nil {
+        held[clientKey] = make(map[string]heldFile)
+    }
+    held[clientKey][relPath] = kept
+}
+
+// dropHeld forgets a held copy, so a file the student deletes and creates
+// again is sent in full.
+func dropHeld(clientKey, relPath string) {
+    heldMu.Lock()
+    defer heldMu.Unlock()
+
+    delete(held[clientKey], relPath)
+}
+
+func loadHeld() error {
+    heldMu.Lock()
+    defer heldMu.Unlock()
+
+    path := filepath.Join(BASE_DIR, HELD_FILE)
+    data, err := os.ReadFile(path)
+    if os.IsNotExist(err) {
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+    if err := json.Unmarshal(data, &held); err != nil {
+        return fmt.Errorf("%s: %v", path, err)
+    }
+    // Held before clients' paths were stored with forward slashes
+    for _, files := range held {
+        for relPath, file := range files {
+            if normalized := slashPath(relPath); normalized != relPath {
+                delete(files, relPath)
+                files[normalized] = file
+            }
+        }
+    }
+    return nil
+}
+
+// saveHeld writes the held copies to a temporary file first so a crash
+// never leaves HELD_FILE half written.
+func saveHeld() error {
+    heldMu.Lock()
+    defer heldMu.Unlock()
+
+    data, err := json.MarshalIndent(held, "", "  ")
+    if err != nil {
+        return err
+    }
+    path := filepath.Join(BASE_DIR, HELD_FILE)
+    if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+        return err
+    }
+    return os.Rename(path+".tmp", path)
+}
+
+// limitError is a resource limit the client ran into. It ends the session
+// with a Rejection.
+type limitError struct {
+    reason string
+}
+
+func (e *limitError) Error() string {
+    return e.reason
+}
+
+// checkLimits counts a new file against the session limits. It returns how
+// many content bytes the file may still carry, -1 for no limit, and the
+// reason to give when it carries more.
+func checkLimits(session *Session, header protocol.FileHeader, limits protocol.Limits) (int64, string, error) {
+    if header.IsDir {
+        return -1, "", nil
+    }
+    // A file sent again is still one file, and of its content only what
+    // comes after the new offset is counted again
+    counted, seen := session.Counted[header.RelativePath]
+    if !seen {
+        session.Files++
+        if limits.MaxFiles > 0 && session.Files > limits.MaxFiles {
+            return 0, "", &limitError{reason: fmt.Sprintf("more than %d files in one session", limits.MaxFiles)}
+        }
+    } else if counted > header.Offset {
+        session.BytesReceived -= counted - header.Offset
+        counted = header.Offset
+    }
+    session.Counted[header.RelativePath] = counted
+
+    allowed, reason := int64(-1), ""
+    if limits.MaxFileSize > 0 {
+        allowed = limits.MaxFileSize - header.Offset
+        reason = fmt.Sprintf("%s is larger than %d bytes", header.RelativePath, limits.MaxFileSize)
+    }
+    if limits.MaxSessionBytes > 0 {
+        left := limits.MaxSessionBytes - session.BytesReceived
+        if allowed < 0 || left < allowed {
+            allowed = left
+            reason = fmt.Sprintf("more than %d bytes in one session", limits.MaxSessionBytes)
+        }
+    }
+    if allowed >= 0 && header.Size-header.Offset > allowed {
+        return 0, "", &limitError{reason: reason}
+    }
+    return allowed, reason, nil
+}
+
+// limitReader fails once more than n bytes are read from it, so the limits
+// hold while data arrives and not only against what the header claims.
+type limitReader struct {
+    r      io.Reader
+    n      int64
+    reason string
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+    if l.n < 0 {
+        return 0, &limitError{reason: l.reason}
+    }
+    n, err := l.r.Read(p)
+    l.n -= int64(n)
+    if l.n < 0 {
+        return n, &limitError{reason: l.reason}
+    }
+    return n, err
+}
+
+// rejectClient tells the client which limit it hit and logs it. The
+// connection is drained briefly so the client can read the rejection
+// before it is closed.
+func rejectClient(session *Session, conn *protocol.DeadlineConn, writer *bufio.Writer, reason string) {
+    hello := protocol.Hello{
+        MachineID:    session.MachineID,
+        Hostname:     session.Hostname,
+        ClientIP:     session.ClientIP,
+        AgentVersion: session.AgentVersion,
+    }
+    logRejected(conn.RemoteAddr().String(), hello, reason)
+
+    protocol.WriteJSONFrame(writer, protocol.FrameRejected, protocol.Rejection{Reason: reason})
+    writer.Flush()
+
+    conn.ReadTimeout = 0
+    conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+    io.Copy(io.Discard, conn)
+}
+
+// acquireConnection takes a connection slot for ip, or returns why the
+// connection is refused. Taken slots are freed by releaseConnection.
+func acquireConnection(ip string, config Config) string {
+    connsMu.Lock()
+    defer connsMu.Unlock()
+
+    if config.MaxConns > 0 && conns >= config.MaxConns {
+        return fmt.Sprintf("server busy: %d connections open", conns)
+    }
+    if config.MaxConnsPerIP > 0 && connsByIP[ip] >= config.MaxConnsPerIP {
+        return fmt.Sprintf("too many connections from %s", ip)
+    }
+    conns++
+    connsByIP[ip]++
+    return ""
+}
+
+func releaseConnection(ip string) {
+    connsMu.Lock()
+    defer connsMu.Unlock()
+
+    conns--
+    connsByIP[ip]--
+    if connsByIP[ip] <= 0 {
+        delete(connsByIP, ip)
+    }
+}
+
+// reconcile checks the client's manifest against the files stored in this
+// session. Stored files are hashed again, so one that changed or vanished on
+// disk after its ack is caught too.
+func reconcile(session *Session, end protocol.ManifestEnd) (protocol.SubmissionStatus, error) {
+    status := protocol.SubmissionStatus{Files: len(session.Manifest)}
+
+    for _, entry := range session.Manifest {
+        // Hashing a large submission can outlast the client's read timeout
+        if err := session.Heartbeat.Beat(); err != nil {
+            return status, err
+        }
+        fullPath, ok := session.Stored[entry.RelativePath]
+        if !ok {
+            status.Missing = append(status.Missing, entry.RelativePath)
+            continue
+        }
+        if entry.IsDir {
+            continue
+        }
+        sum, size, err := hashFile(fullPath)
+        if err != nil {
+            status.Missing = append(status.Missing, entry.RelativePath)
+            continue
+        }
+        if size != entry.Size || sum != entry.SHA256 {
+            status.Corrupt = append(status.Corrupt, entry.RelativePath)
+        }
+    }
+
+    switch {
+    case len(status.Corrupt) > 0:
+        status.Status = protocol.StatusCorrupt
+    case len(status.Missing) > 0 || end.Files != len(session.Manifest):
+        status.Status = protocol.StatusIncomplete
+    default:
+        status.Status = protocol.StatusComplete
+    }
+    return status, nil
+}
+
+// disconnectReason describes why reading from a client failed, for the
+// disconnect record.
+func disconnectReason(err error, timeout time.Duration) string {
+    if ne, ok := err.(net.Error); ok && ne.Timeout() {
+        return fmt.Sprintf("no data for %v", timeout)
+    }
+    return err.Error()
+}
+
+// writeEvent records what happened to a client besides files arriving: a
+// deletion or read error it reported, or the connection ending.
+func writeEvent(session *Session, event, relPath, detail string) {
+    eventsMu.Lock()
+    defer eventsMu.Unlock()
+
+    f, err := os.OpenFile(filepath.Join(BASE_DIR, EVENTS_FILE), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+    if err != nil {
+        fmt.Printf("Error writing client event: %v\n", err)
+        return
+    }
+    defer f.Close()
+
+    fmt.Fprintf(f, "%s session=%s host=%q ip=%s event=%s",
+        time.Now().Format("2006-01-02 15:04:05"), session.ID, session.Hostname, session.ClientIP, event)
+    if relPath != "" {
+        fmt.Fprintf(f, " path=%q", relPath)
+    }
+    if detail != "" {
+        fmt.Fprintf(f, " detail=%q", detail)
+    }
+    fmt.Fprintln(f)
+}
+
+func writeSubmission(session *Session, status protocol.SubmissionStatus, reason string) {
+    submissionsMu.Lock()
+    defer submissionsMu.Unlock()
+
+    if err := os.MkdirAll(BASE_DIR, 0755); err != nil {
+        fmt.Printf("Error writing submission status: %v\n", err)
+        return
+    }
+    f, err := os.OpenFile(filepath.Join(BASE_DIR, SUBMISSIONS_FILE), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+    if err != nil {
+        fmt.Printf("Error writing submission status: %v\n", err)
+        return
+    }
+    defer f.Close()
+
+    fmt.Fprintf(f, "%s session=%s host=%q ip=%s status=%s files=%d missing=%q corrupt=%q",
+        time.Now().Format("2006-01-02 15:04:05"), session.ID, session.Hostname, session.ClientIP,
+        status.Status, status.Files, status.Missing, status.Corrupt)
+    if reason != "" {
+        fmt.Fprintf(f, " reason=%q", reason)
+    }
+    fmt.Fprintln(f)
+}
+
+// writeSubmissionRecord writes the record of the session's folder. The file
+// list is read from the folder's tree, so a resumed session lists what the
+// earlier connections stored as well.
+func writeSubmissionRecord(session *Session, ended time.Time) {
+    record := SubmissionRecord{
+        SessionID:    session.ID,
+        MachineID:    session.MachineID,
+        Hostname:     session.Hostname,
+        ClientIP:     session.ClientIP,
+        AgentVersion: session.AgentVersion,
+        Started:      session.Started,
+        Ended:        ended,
+        Status:       session.Status,
+    }
+    tree, err := loadTree(session.Folder)
+    if err != nil {
+        fmt.Printf("Error reading submission tree: %v\n", err)
+    }
+    for _, entry := range tree {
+        if !entry.IsDir {
+            record.Files = append(record.Files, entry.RelativePath)
+        }
+    }
+
+    data, err := json.MarshalIndent(record, "", "  ")
+    if err != nil {
+        fmt.Printf("Error writing submission record: %v\n", err)
+        return
+    }
+    path := filepath.Join(session.Folder, SUBMISSION_RECORD)
+    if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+        fmt.Printf("Error writing submission record: %v\n", err)
+        return
+    }
+    if err := os.Rename(path+".tmp", path); err != nil {
+        fmt.Printf("Error writing submission record: %v\n", err)
+    }
+}
+
+// closeSubmission completes the record of a session that stored files and
+// adds the session to the client's history.
+func closeSubmission(session *Session) {
+    if session.Folder != "" {
+        writeSubmissionRecord(session, time.Now())
+        if mirror != nil {
+            if err := mirror.Finish(session); err != nil {
+                fmt.Printf("Error mirroring submission record of %s: %v\n", session.Folder, err)
+            }
+        }
+    }
+    writeSnapshot(session)
+}
+
+// TreeEntry is one file or folder of a submission, appended to the TREE_FILE
+// of the submission folder as soon as it is verified. The content is the
+// blob named by SHA256; folders have none. A later line for the same path
+// replaces an earlier one.
+type TreeEntry struct {
+    RelativePath string
+    IsDir        bool
+    Size         int64
+    SHA256       string
+    ModTime      time.Time   // last modification on the client
+    Mode         os.FileMode // permission bits on the client
+}
+
+// Guards appends to the tree files of all submission folders.
+var treeMu sync.Mutex
+
+// recordTree adds a verified file or folder to the session's tree. It is
+// appended right away, so a server that dies mid-session still knows which
+// blobs the session stored.
+func recordTree(session *Session, header protocol.FileHeader, sum string, size int64) {
+    entry := TreeEntry{
+        RelativePath: header.RelativePath,
+        IsDir:        header.IsDir,
+        Size:         size,
+        SHA256:       sum,
+        ModTime:      header.ModTime,
+        Mode:         header.Mode,
+    }
+    if mirror != nil {
+        if err := mirror.Store(session, entry); err != nil {
+            fmt.Printf("Error mirroring %s of %s: %v\n", entry.RelativePath, session.Folder, err)
+        }
+    }
+
+    data, err := json.Marshal(entry)
+    if err != nil {
+        fmt.Printf("Error writing submission tree: %v\n", err)
+        return
+    }
+
+    treeMu.Lock()
+    defer treeMu.Unlock()
+
+    f, err := os.OpenFile(filepath.Join(session.Folder, TREE_FILE), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+    if err != nil {
+        fmt.Printf("Error writing submission tree: %v\n", err)
+        return
+    }
+    defer f.Close()
+    if _, err := f.Write(append(data, '\n')); err != nil {
+        fmt.Printf("Error writing submission tree: %v\n", err)
+    }
+}
+
+// loadTree reads the tree of a submission folder, sorted by path. A folder
+// without a tree has no entries.
+func loadTree(folder string) ([]TreeEntry, error) {
+    f, err := os.Open(filepath.Join(folder, TREE_FILE))
+    if os.IsNotExist(err) {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+
+    byPath := make(map[string]TreeEntry)
+    scanner := bufio.NewScanner(f)
+    for line := 1; scanner.Scan(); line++ {
+        var entry TreeEntry
+        if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+            return nil, fmt.Errorf("%s line %d: %v", TREE_FILE, line, err)
+        }
+        byPath[entry.RelativePath] = entry
+    }
+    if err := scanner.Err(); err != nil {
+        return nil, err
+    }
+
+    tree := make([]TreeEntry, 0, len(byPath))
+    for _, entry := range byPath {
+        tree = append(tree, entry)
+    }
+    sort.Slice(tree, func(i, j int) bool { return tree[i].RelativePath < tree[j].RelativePath })
+    return tree, nil
+}
+
+// writeTree replaces the tree of a submission folder.
+func writeTree(folder string, tree []TreeEntry) error {
+    var buf strings.Builder
+    for _, entry := range tree {
+        data, err := json.Marshal(entry)
+        if err != nil {
+            return err
+        }
+        buf.Write(data)
+        buf.WriteByte('\n')
+    }
+
+    treeMu.Lock()
+    defer treeMu.Unlock()
+
+    path := filepath.Join(folder, TREE_FILE)
+    if err := os.WriteFile(path+".tmp", []byte(buf.String()), 0644); err != nil {
+        return err
+    }
+    return os.Rename(path+".tmp", path)
+}
+
+// submissionFolders lists the folders in BASE_DIR that have a tree.
+func submissionFolders() ([]string, error) {
+    entries, err := os.ReadDir(BASE_DIR)
+    if err != nil {
+        return nil, err
+    }
+    var folders []string
+    for _, entry := range entries {
+        if !entry.IsDir() {
+            continue
+        }
+        if _, err := os.Stat(filepath.Join(BASE_DIR, entry.Name(), TREE_FILE)); err == nil {
+            folders = append(folders, entry.Name())
+        }
+    }
+    return folders, nil
+}
+
+// Mirror keeps a second copy of the submissions for archiving, e.g. on
+// the campus object store. It is not where submissions are stored: every
+// file lands in the local blob store, which resume, delta sync, the latest
+// view and the maintenance commands work from, and is acknowledged from
+// there. The mirror gets each file after that, once it is verified, and
+// the submission record whenever a session ends. Its errors are logged and
+// never reach the client.
+type Mirror interface {
+    Store(session *Session, entry TreeEntry) error
+    Finish(session *Session) error
+}
+
+// newMirror builds the mirror picked with --mirror, nil for none.
+func newMirror(config Config) (Mirror, error) {
+    switch config.Mirror {
+    case "":
+        return nil, nil
+    case "tar":
+        return &tarMirror{}, nil
+    case "s3":
+        client := &s3.Client{
+            Bucket:    config.MirrorBucket,
+            Region:    config.MirrorRegion,
+            Prefix:    config.MirrorPrefix,
+            AccessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+            SecretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+            HTTP:      &http.Client{Timeout: 60 * time.Second},
+        }
+        endpoint, err := url.Parse(config.MirrorEndpoint)
+        if err != nil || endpoint.Host == "" || (endpoint.Scheme != "http" && endpoint.Scheme != "https") {
+            return nil, fmt.Errorf("--mirror-endpoint needs a URL like https://s3.kampus.ac.id or http://127.0.0.1:9000")
+        }
+        client.Endpoint = endpoint.Scheme + "://" + endpoint.Host
+        if client.Bucket == "" {
+            return nil, fmt.Errorf("--mirror-bucket is required with --mirror s3")
+        }
+        if client.AccessKey == "" || client.SecretKey == "" {
+            return nil, fmt.Errorf("set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY for --mirror s3")
+        }
+        if client.Prefix != "" && !strings.HasSuffix(client.Prefix, "/") {
+            client.Prefix += "/"
+        }
+        return newS3Mirror(client), nil
+    }
+    return nil, fmt.Errorf("unknown mirror %q (known: tar, s3)", config.Mirror)
+}
+
+// tarMirror writes every session into one tar archive next to its
+// submission folder, HOST_IP_TIMESTAMP.tar, which grows as files arrive.
+// The archive is complete after every file; unpacking it gives the
+// HOST_IP_TIMESTAMP/relative/path layout.
+type tarMirror struct {
+    mu sync.Mutex
+}
+
+func (s *tarMirror) Store(session *Session, entry TreeEntry) error {
+    // HTTP uploads and legacy clients send neither mode nor time; unpacked
+    // with nothing those would be unreadable files from 1970
+    mode := entry.Mode.Perm()
+    if mode == 0 {
+        mode = 0644
+        if entry.IsDir {
+            mode = 0755
+        }
+    }
+    modTime := entry.ModTime
+    if modTime.IsZero() {
+        modTime = time.Now()
+    }
+
+    name := filepath.Base(session.Folder) + "/" + entry.RelativePath
+    if entry.IsDir {
+        return s.append(session, &tar.Header{
+            Typeflag: tar.TypeDir,
+            Name:     name + "/",
+            Mode:     int64(mode),
+            ModTime:  modTime,
+        }, nil)
+    }
+
+    blob, err := os.Open(blobPath(entry.SHA256))
+    if err != nil {
+        return err
+    }
+    defer blob.Close()
+    return s.append(session, &tar.Header{
+        Typeflag: tar.TypeReg,
+        Name:     name,
+        Size:     entry.Size,
+        Mode:     int64(mode),
+        ModTime:  modTime,
+    }, blob)
+}
+
+// Finish adds the submission record. A resumed session adds it again; the
+// later copy wins when the archive is unpacked.
+func (s *tarMirror) Finish(session *Session) error {
+    record, err := os.ReadFile(filepath.Join(session.Folder, SUBMISSION_RECORD))
+    if err != nil {
+        return err
+    }
+    return s.append(session, &tar.Header{
+        Typeflag: tar.TypeReg,
+        Name:     filepath.Base(session.Folder) + "/" + SUBMISSION_RECORD,
+        Size:     int64(len(record)),
+        Mode:     0644,
+        ModTime:  time.Now(),
+    }, bytes.NewReader(record))
+}
+
+// append writes one entry over the end-of-archive blocks left by the last
+// one and closes the archive again.
+func (s *tarMirror) append(session *Session, header *tar.Header, content io.Reader) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    f, err := os.OpenFile(session.Folder+".tar", os.O_RDWR|os.O_CREATE, 0644)
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+    info, err := f.Stat()
+    if err != nil {
+        return err
+    }
+    end := info.Size() - 2*512
+    if end < 0 {
+        end = 0
+    }
+    if _, err := f.Seek(end, io.SeekStart); err != nil {
+        return err
+    }
+
+    tw := tar.NewWriter(f)
+    err = tw.WriteHeader(header)
+    if err == nil && content != nil {
+        _, err = io.Copy(tw, content)
+    }
+    if err == nil {
+        err = tw.Close()
+    }
+    if err != nil {
+        // Put the end-of-archive blocks back after the last good entry
+        f.Truncate(end)
+        f.WriteAt(make([]byte, 2*512), end)
+        return err
+    }
+    return f.Close()
+}
+
+// s3Mirror uploads every file to an S3-compatible object store, such
+// as the campus MinIO, under PREFIX/HOST_IP_TIMESTAMP/relative/path, with
+// the submission record and tree next to it. Uploads run in the background
+// so a slow or unreachable store never holds up the acks: Store and Finish
+// only queue them, and s3Workers goroutines send them, retrying each one
+// before giving up with an error in the log. Uploads still queued when the
+// server stops are lost; the files stay in the local blob store either way.
+type s3Mirror struct {
+    client  *s3.Client
+    mu      sync.Mutex
+    queued  *sync.Cond
+    pending []s3Upload
+}
+
+// s3Upload is an object waiting for the upload workers. Sum is empty for
+// files that can still change, which are hashed when they are sent.
+type s3Upload struct {
+    Key  string
+    File string
+    Sum  string
+    Size int64
+}
+
+const (
+    s3Workers  = 4
+    s3Attempts = 5
 )
 
-type FileInfo struct {
+func newS3Mirror(client *s3.Client) *s3Mirror {
+    s := &s3Mirror{client: client}
+    s.queued = sync.NewCond(&s.mu)
+    for i := 0; i < s3Workers; i++ {
+        go s.work()
+    }
+    return s
+}
+
+func (s *s3Mirror) Store(session *Session, entry TreeEntry) error {
+    // Object stores have no folders, they exist through their files
+    if entry.IsDir {
+        return nil
+    }
+    s.queue(s3Upload{Key: filepath.Base(session.Folder) + "/" + entry.RelativePath, File: blobPath(entry.SHA256), Sum: entry.SHA256, Size: entry.Size})
+    return nil
+}
+
+func (s *s3Mirror) Finish(session *Session) error {
+    for _, name := range []string{SUBMISSION_RECORD, TREE_FILE} {
+        file := filepath.Join(session.Folder, name)
+        if _, err := os.Stat(file); os.IsNotExist(err) {
+            continue
+        }
+        s.queue(s3Upload{Key: filepath.Base(session.Folder) + "/" + name, File: file})
+    }
+    return nil
+}
+
+func (s *s3Mirror) queue(upload s3Upload) {
+    s.mu.Lock()
+    s.pending = append(s.pending, upload)
+    s.mu.Unlock()
+    s.queued.Signal()
+}
+
+// work sends queued uploads one after the other, for good.
+func (s *s3Mirror) work() {
+    for {
+        s.mu.Lock()
+        for len(s.pending) == 0 {
+            s.queued.Wait()
+        }
+        upload := s.pending[0]
+        s.pending = s.pending[1:]
+        s.mu.Unlock()
+
+        var err error
+        for attempt := 1; attempt <= s3Attempts; attempt++ {
+            if err = s.send(upload); err == nil {
+                break
+            }
+            if attempt < s3Attempts {
+                time.Sleep(time.Duration(attempt) * 5 * time.Second)
+            }
+        }
+        if err != nil {
+            fmt.Printf("Error uploading %s to S3, gave up after %d attempts: %v\n", upload.Key, s3Attempts, err)
+        }
+    }
+}
+
+func (s *s3Mirror) send(upload s3Upload) error {
+    sum, size := upload.Sum, upload.Size
+    if sum == "" {
+        var err error
+        if sum, size, err = hashFile(upload.File); err != nil {
+            return err
+        }
+    }
+    return s.client.Put(upload.Key, upload.File, sum, size)
+}
+
+// latestPath is where relPath of the session's client appears in its
+// latest view, LATEST_DIR/HOST_IP. It is empty for paths that would end up
+// outside that folder.
+func latestPath(session *Session, relPath string) string {
+    base, _ := filepath.Abs(filepath.Join(BASE_DIR, LATEST_DIR))
+    full, _ := filepath.Abs(filepath.Join(base, clientDirName(session), localPath(relPath)))
+    if !strings.HasPrefix(full, base+string(os.PathSeparator)) {
+        return ""
+    }
+    return full
+}
+
+// updateLatest puts a newly verified copy into the client's latest view,
+// which holds the newest copy of every file the client still has no matter
+// which submission folder it arrived in. Files are copies with the
+// student's edit time, never links: the blob is shared with every
+// submission holding the same content and must not change with them.
+func updateLatest(session *Session, relPath, fullPath string, isDir bool, modTime time.Time) {
+    dest := latestPath(session, relPath)
+    if dest == "" {
+        return
+    }
+    if isDir {
+        if err := os.MkdirAll(dest, 0755); err != nil {
+            fmt.Printf("Error updating latest view: %v\n", err)
+        }
+        return
+    }
+    if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+        fmt.Printf("Error updating latest view: %v\n", err)
+        return
+    }
+    os.Remove(dest)
+    if err := copyFile(fullPath, dest); err != nil {
+        fmt.Printf("Error updating latest view: %v\n", err)
+        return
+    }
+    if !modTime.IsZero() {
+        os.Chtimes(dest, time.Now(), modTime)
+    }
+}
+
+// dropLatest removes a file the client deleted from its latest view. The
+// copies in the submission folders stay.
+func dropLatest(session *Session, relPath string) {
+    if dest := latestPath(session, relPath); dest != "" {
+        os.Remove(dest)
+    }
+}
+
+func copyFile(src, dst string) error {
+    in, err := os.Open(src)
+    if err != nil {
+        return err
+    }
+    defer in.Close()
+
+    out, err := os.Create(dst)
+    if err != nil {
+        return err
+    }
+    if _, err := io.Copy(out, in); err != nil {
+        out.Close()
+        return err
+    }
+    return out.Close()
+}
+
+// Snapshot is the state of a client's files after one session, kept as
+// HISTORY_DIR/HOST_IP/<ID>.json. Its files point at the stored copies in
+// the submission folders, which are never changed afterwards, so every
+// version stays available until prune drops the last snapshot using it.
+type Snapshot struct {
+    ID          string // starts with the creation time, so IDs sort by age
+    SessionID   string
+    SessionName string `json:",omitempty"` // the server's --name, i.e. the exam
+    Hostname    string
+    ClientIP    string
+    Created     time.Time
+    Status      string
+    Files       []SnapshotFile
+}
+
+// SnapshotFile is one file or folder of a Snapshot.
+type SnapshotFile struct {
+    RelativePath string
+    IsDir        bool
+    Path         string // the stored copy, relative to BASE_DIR
+}
+
+// Guards the snapshot files shared by all client goroutines.
+var historyMu sync.Mutex
+
+// writeSnapshot records the files a session ended with as a snapshot of its
+// client. With delta sync the held files a session skipped count as stored,
+// so the snapshot is the client's whole submission. Sessions that changed
+// nothing, like most reconnects, add no snapshot.
+func writeSnapshot(session *Session) {
+    if len(session.Stored) == 0 {
+        return
+    }
+
+    snapshot := Snapshot{
+        SessionID:   session.ID,
+        SessionName: sessionName,
+        Hostname:    session.Hostname,
+        ClientIP:    session.ClientIP,
+        Created:     time.Now(),
+        Status:      session.Status,
+    }
+    snapshot.ID = snapshot.Created.Format("2006_01_02___15_04_05") + "_" + session.ID
+
+    relPaths := make([]string, 0, len(session.Stored))
+    for relPath := range session.Stored {
+        relPaths = append(relPaths, relPath)
+    }
+    sort.Strings(relPaths)
+    for _, relPath := range relPaths {
+        fullPath := session.Stored[relPath]
+        info, err := os.Stat(fullPath)
+        if err != nil {
+            continue
+        }
+        stored, err := filepath.Rel(BASE_DIR, fullPath)
+        if err != nil {
+            continue
+        }
+        snapshot.Files = append(snapshot.Files, SnapshotFile{RelativePath: relPath, IsDir: info.IsDir(), Path: filepath.ToSlash(stored)})
+    }
+
+    historyMu.Lock()
+    defer historyMu.Unlock()
+
+    dir := filepath.Join(BASE_DIR, HISTORY_DIR, clientDirName(session))
+    snapshots, err := loadSnapshots(dir)
+    if err != nil {
+        fmt.Printf("Error reading history of %s: %v\n", clientDirName(session), err)
+        return
+    }
+    if len(snapshots) > 0 && sameFiles(snapshots[len(snapshots)-1].Files, snapshot.Files) {
+        return
+    }
+
+    if err := os.MkdirAll(dir, 0755); err != nil {
+        fmt.Printf("Error writing snapshot: %v\n", err)
+        return
+    }
+    data, err := json.MarshalIndent(snapshot, "", "  ")
+    if err != nil {
+        fmt.Printf("Error writing snapshot: %v\n", err)
+        return
+    }
+    path := filepath.Join(dir, snapshot.ID+".json")
+    if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+        fmt.Printf("Error writing snapshot: %v\n", err)
+        return
+    }
+    if err := os.Rename(path+".tmp", path); err != nil {
+        fmt.Printf("Error writing snapshot: %v\n", err)
+        return
+    }
+    fmt.Printf("Snapshot %s of %s: %d files\n", snapshot.ID, clientDirName(session), len(snapshot.Files))
+}
+
+// loadSnapshots reads the snapshots in a client's history folder, oldest
+// first. A client without a history has none.
+func loadSnapshots(dir string) ([]Snapshot, error) {
+    entries, err := os.ReadDir(dir)
+    if os.IsNotExist(err) {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    var snapshots []Snapshot
+    for _, entry := range entries {
+        if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+            continue
+        }
+        data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+        if err != nil {
+            return nil, err
+        }
+        var snapshot Snapshot
+        if err := json.Unmarshal(data, &snapshot); err != nil {
+            return nil, fmt.Errorf("%s: %v", entry.Name(), err)
+        }
+        snapshots = append(snapshots, snapshot)
+    }
+    return snapshots, nil
+}
+
+func sameFiles(a, b []SnapshotFile) bool {
+    if len(a) != len(b) {
+        return false
+    }
+    for i := range a {
+        if a[i] != b[i] {
+            return false
+        }
+    }
+    return true
+}
+
+// changedFiles counts the files of a snapshot that are new or another
+// version than in the one before it.
+func changedFiles(previous, snapshot Snapshot) int {
+    before := make(map[string]string, len(previous.Files))
+    for _, file := range previous.Files {
+        before[file.RelativePath] = file.Path
+    }
+    changed := 0
+    for _, file := range snapshot.Files {
+        if path, ok := before[file.RelativePath]; !file.IsDir && (!ok || path != file.Path) {
+            changed++
+        }
+    }
+    return changed
+}
+
+// historyClients lists the clients with a history folder.
+func historyClients() ([]string, error) {
+    entries, err := os.ReadDir(filepath.Join(BASE_DIR, HISTORY_DIR))
+    if os.IsNotExist(err) {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    var clients []string
+    for _, entry := range entries {
+        if entry.IsDir() {
+            clients = append(clients, entry.Name())
+        }
+    }
+    return clients, nil
+}
+
+func snapshotsCommand(args []string) error {
+    client := ""
+    for i := 0; i < len(args); i++ {
+        switch {
+        case client == "" && !strings.HasPrefix(args[i], "--"):
+            client = args[i]
+        default:
+            return fmt.Errorf("unknown snapshots argument: %s", args[i])
+        }
+    }
+
+    if client == "" {
+        clients, err := historyClients()
+        if err != nil {
+            return err
+        }
+        fmt.Printf("%-36s  %9s  %-19s  %s\n", "CLIENT", "SNAPSHOTS", "LAST", "FILES")
+        for _, name := range clients {
+            snapshots, err := loadSnapshots(filepath.Join(BASE_DIR, HISTORY_DIR, name))
+            if err != nil {
+                return err
+            }
+            if len(snapshots) == 0 {
+                continue
+            }
+            last := snapshots[len(snapshots)-1]
+            fmt.Printf("%-36s  %9d  %-19s  %d\n", name, len(snapshots), last.Created.Format("2006-01-02 15:04:05"), len(last.Files))
+        }
+        return nil
+    }
+
+    snapshots, err := loadSnapshots(filepath.Join(BASE_DIR, HISTORY_DIR, client))
+    if err != nil {
+        return err
+    }
+    if len(snapshots) == 0 {
+        return fmt.Errorf("no history for %q (see ./server snapshots)", client)
+    }
+    fmt.Printf("%-40s  %-19s  %-10s  %5s  %7s  %s\n", "SNAPSHOT", "CREATED", "STATUS", "FILES", "CHANGED", "SESSION")
+    for i, snapshot := range snapshots {
+        changed := len(snapshot.Files)
+        if i > 0 {
+            changed = changedFiles(snapshots[i-1], snapshot)
+        }
+        status := snapshot.Status
+        if status == "" {
+            status = "-"
+        }
+        name := snapshot.SessionName
+        if name == "" {
+            name = "-"
+        }
+        fmt.Printf("%-40s  %-19s  %-10s  %5d  %7d  %s\n", snapshot.ID, snapshot.Created.Format("2006-01-02 15:04:05"), status, len(snapshot.Files), changed, name)
+    }
+    return nil
+}
+
+// restoreCommand copies one snapshot out of the history, so the folder can
+// be opened, graded or handed back like the student's own.
+func restoreCommand(args []string) error {
+    if len(args) != 3 {
+        return fmt.Errorf("usage: ./server restore <CLIENT> <SNAPSHOT|last> <DIR>")
+    }
+    client, id, dest := args[0], args[1], args[2]
+
+    snapshots, err := loadSnapshots(filepath.Join(BASE_DIR, HISTORY_DIR, client))
+    if err != nil {
+        return err
+    }
+    var snapshot *Snapshot
+    for i := range snapshots {
+        if snapshots[i].ID == id || id == "last" && i == len(snapshots)-1 {
+            snapshot = &snapshots[i]
+        }
+    }
+    if snapshot == nil {
+        return fmt.Errorf("no snapshot %q of %q (see ./server snapshots %s)", id, client, client)
+    }
+
+    if entries, err := os.ReadDir(dest); err == nil && len(entries) > 0 {
+        return fmt.Errorf("%s is not empty", dest)
+    }
+    if err := os.MkdirAll(dest, 0755); err != nil {
+        return err
+    }
+    for _, file := range snapshot.Files {
+        if err := (protocol.FileHeader{RelativePath: file.RelativePath}).Validate(); err != nil {
+            return err
+        }
+        target := filepath.Join(dest, localPath(file.RelativePath))
+        if file.IsDir {
+            if err := os.MkdirAll(target, 0755); err != nil {
+                return err
+            }
+            continue
+        }
+        if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+            return err
+        }
+        if err := copyFile(filepath.Join(BASE_DIR, filepath.FromSlash(file.Path)), target); err != nil {
+            return fmt.Errorf("error restoring %s: %v", file.RelativePath, err)
+        }
+    }
+    fmt.Printf("Restored snapshot %s of %s (%d files) into %s\n", snapshot.ID, client, len(snapshot.Files), dest)
+    return nil
+}
+
+// pruneCommand applies the retention policy once the exam is over: the
+// first and last snapshots of every client are kept, the others dropped,
+// and stored copies that no kept snapshot or held file uses any more are
+// deleted. During the exam nothing is pruned, so every version survives.
+func pruneCommand(args []string) error {
+    keepFirst, keepLast := -1, -1
+    dryRun := false
+    client := ""
+    for i := 0; i < len(args); i++ {
+        switch {
+        case args[i] == "--keep-first":
+            keepFirst = flagInt(args, &i)
+        case args[i] == "--keep-last":
+            keepLast = flagInt(args, &i)
+        case args[i] == "--dry-run":
+            dryRun = true
+        case client == "" && !strings.HasPrefix(args[i], "--"):
+            client = args[i]
+        default:
+            return fmt.Errorf("unknown prune argument: %s", args[i])
+        }
+    }
+    if keepFirst < 0 && keepLast < 0 {
+        return fmt.Errorf("say what to keep with --keep-first N and/or --keep-last N")
+    }
+    if keepFirst < 0 {
+        keepFirst = 0
+    }
+    if keepLast < 0 {
+        keepLast = 0
+    }
+    if err := loadHeld(); err != nil {
+        return err
+    }
+
+    clients, err := historyClients()
+    if err != nil {
+        return err
+    }
+
+    // Stored copies still used after pruning, over every client
+    used := make(map[string]bool)
+    for _, kept := range held {
+        for _, file := range kept {
+            if stored, err := filepath.Rel(BASE_DIR, file.FullPath); err == nil {
+                used[filepath.ToSlash(stored)] = true
+            }
+        }
+    }
+    dropped := make(map[string]bool)
+    snapshotsDropped := 0
+
+    for _, name := range clients {
+        dir := filepath.Join(BASE_DIR, HISTORY_DIR, name)
+        snapshots, err := loadSnapshots(dir)
+        if err != nil {
+            return err
+        }
+        for i, snapshot := range snapshots {
+            keep := client != "" && name != client || i < keepFirst || i >= len(snapshots)-keepLast
+            for _, file := range snapshot.Files {
+                if keep {
+                    used[file.Path] = true
+                } else if !file.IsDir {
+                    dropped[file.Path] = true
+                }
+            }
+            if keep {
+                continue
+            }
+            snapshotsDropped++
+            if dryRun {
+                fmt.Printf("Would drop snapshot %s of %s\n", snapshot.ID, name)
+                continue
+            }
+            if err := os.Remove(filepath.Join(dir, snapshot.ID+".json")); err != nil {
+                return err
+            }
+        }
+    }
+
+    // Blobs are dropped from the submission trees and then left to gc;
+    // copies stored before content addressing are deleted right here.
+    var paths []string
+    unused := make(map[string]bool)
+    for path := range dropped {
+        if used[path] {
+            continue
+        }
+        if sum := blobOf(path); sum != "" {
+            unused[sum] = true
+        } else {
+            paths = append(paths, path)
+        }
+    }
+    sort.Strings(paths)
+
+    folders, err := submissionFolders()
+    if err != nil {
+        return err
+    }
+    for _, folder := range folders {
+        tree, err := loadTree(filepath.Join(BASE_DIR, folder))
+        if err != nil {
+            return fmt.Errorf("%s: %v", folder, err)
+        }
+        kept := tree[:0]
+        for _, entry := range tree {
+            if !unused[entry.SHA256] {
+                kept = append(kept, entry)
+            }
+        }
+        if len(kept) == len(tree) || dryRun {
+            continue
+        }
+        if err := writeTree(filepath.Join(BASE_DIR, folder), kept); err != nil {
+            return err
+        }
+    }
+
+    var freed int64
+    for sum := range unused {
+        if info, err := os.Stat(blobPath(sum)); err == nil {
+            freed += info.Size()
+        }
+    }
+    for _, path := range paths {
+        fullPath := filepath.Join(BASE_DIR, filepath.FromSlash(path))
+        if info, err := os.Stat(fullPath); err == nil {
+            freed += info.Size()
+        }
+        if dryRun {
+            continue
+        }
+        if err := os.Remove(fullPath); err != nil && !os.IsNotExist(err) {
+            return err
+        }
+        // Folders left empty go too, up to the submission folder
+        for dir := filepath.Dir(fullPath); filepath.Dir(dir) != filepath.Clean(BASE_DIR); dir = filepath.Dir(dir) {
+            if os.Remove(dir) != nil {
+                break
+            }
+        }
+    }
+
+    verb := "Dropped"
+    if dryRun {
+        verb = "Would drop"
+    }
+    fmt.Printf("%s %d snapshots and %d stored versions (%d bytes)\n", verb, snapshotsDropped, len(unused)+len(paths), freed)
+    if dryRun || len(unused) == 0 {
+        return nil
+    }
+    count, gcFreed, err := collectGarbage(false)
+    if err != nil {
+        return err
+    }
+    fmt.Printf("Deleted %d unreferenced blobs (%d bytes); blobs younger than %v wait for the next gc\n", count, gcFreed, gcGrace)
+    return nil
+}
+
+// blobOf returns the SHA-256 of a stored copy when it is a blob, given as a
+// path relative to BASE_DIR, or "" for anything else.
+func blobOf(stored string) string {
+    stored = filepath.ToSlash(stored)
+    if !strings.HasPrefix(stored, BLOBS_DIR+"/") {
+        return ""
+    }
+    return path.Base(stored)
+}
+
+// blobRefs collects every blob still in use, with one user of each for
+// messages: the submission trees, the snapshots and the held files.
+func blobRefs() (map[string]string, error) {
+    refs := make(map[string]string)
+
+    folders, err := submissionFolders()
+    if err != nil {
+        return nil, err
+    }
+    for _, folder := range folders {
+        tree, err := loadTree(filepath.Join(BASE_DIR, folder))
+        if err != nil {
+            return nil, fmt.Errorf("%s: %v", folder, err)
+        }
+        for _, entry := range tree {
+            if entry.SHA256 != "" {
+                refs[entry.SHA256] = folder + "/" + entry.RelativePath
+            }
+        }
+    }
+
+    clients, err := historyClients()
+    if err != nil {
+        return nil, err
+    }
+    for _, name := range clients {
+        snapshots, err := loadSnapshots(filepath.Join(BASE_DIR, HISTORY_DIR, name))
+        if err != nil {
+            return nil, fmt.Errorf("history of %s: %v", name, err)
+        }
+        for _, snapshot := range snapshots {
+            for _, file := range snapshot.Files {
+                if sum := blobOf(file.Path); sum != "" {
+                    refs[sum] = "snapshot " + snapshot.ID + " of " + name + ": " + file.RelativePath
+                }
+            }
+        }
+    }
+
+    if err := loadHeld(); err != nil {
+        return nil, err
+    }
+    for clientKey, files := range held {
+        for relPath, kept := range files {
+            if stored, err := filepath.Rel(BASE_DIR, kept.FullPath); err == nil {
+                if sum := blobOf(stored); sum != "" {
+                    refs[sum] = "held file " + relPath + " of " + clientKey
+                }
+            }
+        }
+    }
+    return refs, nil
+}
+
+// collectGarbage deletes the blobs nothing refers to any more. Blobs
+// younger than gcGrace are left alone. It returns how many blobs and bytes
+// it deleted, or would delete with dryRun.
+func collectGarbage(dryRun bool) (int, int64, error) {
+    refs, err := blobRefs()
+    if err != nil {
+        return 0, 0, err
+    }
+
+    count, freed := 0, int64(0)
+    err = filepath.Walk(filepath.Join(BASE_DIR, BLOBS_DIR), func(blob string, info os.FileInfo, err error) error {
+        if os.IsNotExist(err) {
+            return nil
+        }
+        if err != nil || info.IsDir() {
+            return err
+        }
+        if _, ok := refs[info.Name()]; ok || time.Since(info.ModTime()) < gcGrace {
+            return nil
+        }
+        count++
+        freed += info.Size()
+        if dryRun {
+            fmt.Printf("Would delete blob %s\n", info.Name())
+            return nil
+        }
+        os.Chmod(blob, 0644) // read-only files cannot be removed on Windows
+        if err := os.Remove(blob); err != nil {
+            return err
+        }
+        os.Remove(filepath.Dir(blob))
+        return nil
+    })
+    return count, freed, err
+}
+
+func gcCommand(args []string) error {
+    dryRun := false
+    for _, arg := range args {
+        switch arg {
+        case "--dry-run":
+            dryRun = true
+        default:
+            return fmt.Errorf("unknown gc argument: %s", arg)
+        }
+    }
+
+    count, freed, err := collectGarbage(dryRun)
+    if err != nil {
+        return err
+    }
+    verb := "Deleted"
+    if dryRun {
+        verb = "Would delete"
+    }
+    fmt.Printf("%s %d unreferenced blobs (%d bytes)\n", verb, count, freed)
+    return nil
+}
+
+// fsckCommand checks the store: every blob still hashes to its name, and
+// every blob a tree, snapshot or held file refers to exists.
+func fsckCommand(args []string) error {
+    if len(args) > 0 {
+        return fmt.Errorf("unknown fsck argument: %s", args[0])
+    }
+
+    refs, err := blobRefs()
+    if err != nil {
+        return err
+    }
+
+    problems, blobs := 0, 0
+    present := make(map[string]bool)
+    err = filepath.Walk(filepath.Join(BASE_DIR, BLOBS_DIR), func(blob string, info os.FileInfo, err error) error {
+        if os.IsNotExist(err) {
+            return nil
+        }
+        if err != nil || info.IsDir() {
+            return err
+        }
+        blobs++
+        present[info.Name()] = true
+        sum, _, err := hashFile(blob)
+        if err != nil {
+            fmt.Printf("unreadable blob %s: %v\n", info.Name(), err)
+            problems++
+        } else if sum != info.Name() || filepath.Base(filepath.Dir(blob)) != sum[:2] {
+            fmt.Printf("corrupt blob %s: content hashes to %s\n", blob, sum)
+            problems++
+        }
+        return nil
+    })
+    if err != nil {
+        return err
+    }
+
+    sums := make([]string, 0, len(refs))
+    for sum := range refs {
+        sums = append(sums, sum)
+    }
+    sort.Strings(sums)
+    for _, sum := range sums {
+        if !present[sum] {
+            fmt.Printf("missing blob %s, used by %s\n", sum, refs[sum])
+            problems++
+        }
+    }
+
+    fmt.Printf("Checked %d blobs, %d referenced\n", blobs, len(refs))
+    if problems > 0 {
+        return fmt.Errorf("found %d problems", problems)
+    }
+    return nil
+}
+
+// materializeCommand lays the submissions out as HOST_IP_TIMESTAMP/
+// relative/path again, for instructors who browse the folders. Files are
+// copies with the student's edit time; with --link they are hard links to
+// the read-only blobs instead, which cost no space but show the time the
+// content was first stored. Files that exist already are left alone.
+func materializeCommand(args []string) error {
+    out := BASE_DIR
+    linkFiles := false
+    client := ""
+    for i := 0; i < len(args); i++ {
+        switch {
+        case args[i] == "--out":
+            out = flagValue(args, &i)
+        case args[i] == "--link":
+            linkFiles = true
+        case client == "" && !strings.HasPrefix(args[i], "--"):
+            client = args[i]
+        default:
+            return fmt.Errorf("unknown materialize argument: %s", args[i])
+        }
+    }
+
+    folders, err := submissionFolders()
+    if err != nil {
+        return err
+    }
+    done := 0
+    for _, folder := range folders {
+        if client != "" && !strings.HasPrefix(folder, client+"_") {
+            continue
+        }
+        tree, err := loadTree(filepath.Join(BASE_DIR, folder))
+        if err != nil {
+            return fmt.Errorf("%s: %v", folder, err)
+        }
+        for _, entry := range tree {
+            if err := (protocol.FileHeader{RelativePath: entry.RelativePath}).Validate(); err != nil {
+                return fmt.Errorf("%s: %v", folder, err)
+            }
+            dest := filepath.Join(out, folder, localPath(entry.RelativePath))
+            if entry.IsDir {
+                if err := os.MkdirAll(dest, 0755); err != nil {
+                    return err
+                }
+                continue
+            }
+            if _, err := os.Lstat(dest); err == nil {
+                continue
+            }
+            if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+                return err
+            }
+            blob := blobPath(entry.SHA256)
+            if !linkFiles || os.Link(blob, dest) != nil {
+                if err := copyFile(blob, dest); err != nil {
+                    return fmt.Errorf("%s/%s: %v", folder, entry.RelativePath, err)
+                }
+                if !entry.ModTime.IsZero() {
+                    os.Chtimes(dest, time.Now(), entry.ModTime)
+                }
+            }
+            done++
+        }
+    }
+    fmt.Printf("Materialized %d files into %s\n", done, out)
+    return nil
+}
+
+// ExportManifest is manifest.json at the top of a class archive written by
+// the export command.
+type ExportManifest struct {
+    Class    string
+    Students []ExportStudent
+    Missing  []string `json:",omitempty"` // students of the roster without a submission
+}
+
+// ExportStudent is one student's submission in a class archive: the last
+// snapshot of their client in the exported session or period.
+type ExportStudent struct {
+    Student   string `json:",omitempty"` // from the roster
+    Folder    string // folder of the student's files in the archive
+    Client    string // HOST_IP
+    Hostname  string
+    ClientIP  string
+    Snapshot  string
+    Submitted time.Time
+    Status    string
+    Files     []ExportFile
+}
+
+type ExportFile struct {
     RelativePath string
-    Content      []byte
-    ClientIP     string
-    Username     string
+    Size         int64
+    SHA256       string
+}
+
+// rosterEntry is one line of a roster: client,student,class, where client
+// is the hostname, IP or HOST_IP of the student's lab PC.
+type rosterEntry struct {
+    Client  string
+    Student string
+    Class   string
+}
+
+func loadRoster(file string) ([]rosterEntry, error) {
+    f, err := os.Open(file)
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+
+    r := csv.NewReader(f)
+    r.Comment = '#'
+    r.FieldsPerRecord = 3
+    r.TrimLeadingSpace = true
+    records, err := r.ReadAll()
+    if err != nil {
+        return nil, fmt.Errorf("%s: %v", file, err)
+    }
+    var roster []rosterEntry
+    for i, record := range records {
+        if i == 0 && strings.EqualFold(record[0], "client") {
+            continue // header line
+        }
+        roster = append(roster, rosterEntry{Client: record[0], Student: record[1], Class: record[2]})
+    }
+    return roster, nil
+}
+
+// rosterFor finds the roster line of the client a snapshot came from.
+func rosterFor(roster []rosterEntry, client string, snapshot Snapshot) *rosterEntry {
+    for i, entry := range roster {
+        if strings.EqualFold(entry.Client, snapshot.Hostname) || entry.Client == snapshot.ClientIP || entry.Client == client {
+            return &roster[i]
+        }
+    }
+    return nil
+}
+
+// kelasFolder is the class a submission is filed under without a roster:
+// the first folder with "kelas" in its name, like UAS_2024_KelasA.
+func kelasFolder(snapshot Snapshot) string {
+    for _, file := range snapshot.Files {
+        folders := strings.Split(slashPath(file.RelativePath), "/")
+        if !file.IsDir {
+            folders = folders[:len(folders)-1]
+        }
+        for _, folder := range folders {
+            if strings.Contains(strings.ToLower(folder), "kelas") {
+                return folder
+            }
+        }
+    }
+    return ""
+}
+
+var exportNameReplacer = strings.NewReplacer(" ", "_", "/", "_", "\\", "_", ":", "_", "*", "_", "?", "_", "\"", "_", "<", "_", ">", "_", "|", "_")
+
+// exportCommand hands an exam over to the lecturers: one zip per class with
+// every student's last submission of the session or period and a
+// manifest.json. The
+// archives only depend on what was stored, so exporting twice gives
+// byte-identical files.
+func exportCommand(args []string) error {
+    out := "export"
+    rosterFile := ""
+    name := ""
+    var since, until time.Time
+    for i := 0; i < len(args); i++ {
+        switch args[i] {
+        case "--out":
+            out = flagValue(args, &i)
+        case "--roster":
+            rosterFile = flagValue(args, &i)
+        case "--session":
+            name = flagValue(args, &i)
+        case "--since", "--until":
+            flag := args[i]
+            value := flagValue(args, &i)
+            t, err := time.ParseInLocation("2006-01-02 15:04", value, time.Local)
+            if err != nil {
+                return fmt.Errorf("invalid %s %q (e.g. \"2024-06-10 08:00\")", flag, value)
+            }
+            if flag == "--since" {
+                since = t
+            } else {
+                until = t
+            }
+        default:
+            return fmt.Errorf("unknown export argument: %s", args[i])
+        }
+    }
+
+    var roster []rosterEntry
+    if rosterFile != "" {
+        var err error
+        if roster, err = loadRoster(rosterFile); err != nil {
+            return err
+        }
+    }
+
+    clients, err := historyClients()
+    if err != nil {
+        return err
+    }
+    classes := make(map[string]*ExportManifest)
+    classFor := func(name string) *ExportManifest {
+        if classes[name] == nil {
+            classes[name] = &ExportManifest{Class: name, Students: []ExportStudent{}}
+        }
+        return classes[name]
+    }
+    submitted := make(map[*rosterEntry]bool)
+    for _, client := range clients {
+        snapshots, err := loadSnapshots(filepath.Join(BASE_DIR, HISTORY_DIR, client))
+        if err != nil {
+            return fmt.Errorf("history of %s: %v", client, err)
+        }
+        var last *Snapshot
+        for i, snapshot := range snapshots {
+            if name != "" && snapshot.SessionName != name {
+                continue
+            }
+            if (since.IsZero() || !snapshot.Created.Before(since)) && (until.IsZero() || snapshot.Created.Before(until)) {
+                last = &snapshots[i]
+            }
+        }
+        if last == nil {
+            continue
+        }
+
+        student := ExportStudent{
+            Folder:    client,
+            Client:    client,
+            Hostname:  last.Hostname,
+            ClientIP:  last.ClientIP,
+            Snapshot:  last.ID,
+            Submitted: last.Created,
+            Status:    last.Status,
+        }
+        class := kelasFolder(*last)
+        if entry := rosterFor(roster, client, *last); entry != nil {
+            submitted[entry] = true
+            student.Student = entry.Student
+            if entry.Student != "" {
+                student.Folder = exportNameReplacer.Replace(entry.Student)
+            }
+            class = entry.Class
+        }
+        if class == "" {
+            class = "Unassigned"
+        }
+        for _, file := range last.Files {
+            if file.IsDir {
+                continue
+            }
+            stored := filepath.Join(BASE_DIR, filepath.FromSlash(file.Path))
+            sum := blobOf(file.Path)
+            info, err := os.Stat(stored)
+            if err == nil && sum == "" {
+                sum, _, err = hashFile(stored)
+            }
+            if err != nil {
+                return fmt.Errorf("%s of %s: %v (see ./server fsck)", file.RelativePath, client, err)
+            }
+            student.Files = append(student.Files, ExportFile{RelativePath: slashPath(file.RelativePath), Size: info.Size(), SHA256: sum})
+        }
+        sort.Slice(student.Files, func(i, j int) bool { return student.Files[i].RelativePath < student.Files[j].RelativePath })
+
+        manifest := classFor(class)
+        manifest.Students = append(manifest.Students, student)
+    }
+    for i := range roster {
+        if !submitted[&roster[i]] {
+            manifest := classFor(roster[i].Class)
+            manifest.Missing = append(manifest.Missing, roster[i].Student)
+        }
+    }
+    if len(classes) == 0 && name != "" {
+        return fmt.Errorf("no submissions of session %q in %s", name, BASE_DIR)
+    }
+    if len(classes) == 0 {
+        return fmt.Errorf("no submissions in %s", BASE_DIR)
+    }
+
+    if err := os.MkdirAll(out, 0755); err != nil {
+        return err
+    }
+    names := make([]string, 0, len(classes))
+    for name := range classes {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    for _, name := range names {
+        manifest := classes[name]
+        sort.Strings(manifest.Missing)
+        sort.Slice(manifest.Students, func(i, j int) bool { return manifest.Students[i].Client < manifest.Students[j].Client })
+        // Two students with the same name keep apart by their PC
+        seen := make(map[string]int)
+        for _, student := range manifest.Students {
+            seen[strings.ToLower(student.Folder)]++
+        }
+        for i, student := range manifest.Students {
+            if seen[strings.ToLower(student.Folder)] > 1 {
+                manifest.Students[i].Folder += "_" + student.Client
+            }
+        }
+        sort.Slice(manifest.Students, func(i, j int) bool { return manifest.Students[i].Folder < manifest.Students[j].Folder })
+
+        archive := filepath.Join(out, exportNameReplacer.Replace(name)+".zip")
+        if err := writeClassArchive(archive, manifest); err != nil {
+            return fmt.Errorf("%s: %v", archive, err)
+        }
+        files := 0
+        for _, student := range manifest.Students {
+            files += len(student.Files)
+        }
+        fmt.Printf("%s: %d students, %d files, %d missing -> %s\n", name, len(manifest.Students), files, len(manifest.Missing), archive)
+    }
+    return nil
+}
+
+// writeClassArchive writes the zip of one class. Entries are in a fixed
+// order and dated with the submit time, so the same submissions always
+// give the same bytes.
+func writeClassArchive(archive string, manifest *ExportManifest) error {
+    data, err := json.MarshalIndent(manifest, "", "  ")
+    if err != nil {
+        return err
+    }
+    var newest time.Time
+    for _, student := range manifest.Students {
+        if student.Submitted.After(newest) {
+            newest = student.Submitted
+        }
+    }
+    if newest.IsZero() {
+        newest = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+    }
+
+    f, err := os.Create(archive + ".tmp")
+    if err != nil {
+        return err
+    }
+    defer os.Remove(archive + ".tmp")
+    defer f.Close()
+
+    zw := zip.NewWriter(f)
+    w, err := zw.CreateHeader(&zip.FileHeader{Name: "manifest.json", Method: zip.Deflate, Modified: newest})
+    if err != nil {
+        return err
+    }
+    if _, err := w.Write(data); err != nil {
+        return err
+    }
+
+    for _, student := range manifest.Students {
+        snapshots, err := loadSnapshots(filepath.Join(BASE_DIR, HISTORY_DIR, student.Client))
+        if err != nil {
+            return err
+        }
+        stored := make(map[string]string)
+        for _, snapshot := range snapshots {
+            if snapshot.ID == student.Snapshot {
+                for _, file := range snapshot.Files {
+                    stored[slashPath(file.RelativePath)] = filepath.Join(BASE_DIR, filepath.FromSlash(file.Path))
+                }
+            }
+        }
+        for _, file := range student.Files {
+            if err := (protocol.FileHeader{RelativePath: file.RelativePath}).Validate(); err != nil {
+                return fmt.Errorf("%s: %v", student.Client, err)
+            }
+            w, err := zw.CreateHeader(&zip.FileHeader{
+                Name:     student.Folder + "/" + file.RelativePath,
+                Method:   zip.Deflate,
+                Modified: student.Submitted,
+            })
+            if err != nil {
+                return err
+            }
+            if err := copyVerified(w, stored[file.RelativePath], file.SHA256); err != nil {
+                return fmt.Errorf("%s of %s: %v (see ./server fsck)", file.RelativePath, student.Client, err)
+            }
+        }
+    }
+    if err := zw.Close(); err != nil {
+        return err
+    }
+    if err := f.Close(); err != nil {
+        return err
+    }
+    return os.Rename(archive+".tmp", archive)
+}
+
+// copyVerified copies a stored file to w, failing when its content does
+// not hash to sum.
+func copyVerified(w io.Writer, stored, sum string) error {
+    f, err := os.Open(stored)
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+    hasher := sha256.New()
+    if _, err := io.Copy(io.MultiWriter(w, hasher), f); err != nil {
+        return err
+    }
+    if got := hex.EncodeToString(hasher.Sum(nil)); got != sum {
+        return fmt.Errorf("content hashes to %s instead of %s", got, sum)
+    }
+    return nil
+}
+
+// openResumable returns the ID to use for a new connection. A previous
+// session ID is honoured only for the same client and before it expires.
+func openResumable(previousID, clientKey string) (string, bool) {
+    resumeMu.Lock()
+    defer resumeMu.Unlock()
+
+    for id, record := range resumable {
+        if time.Since(record.LastSeen) > resumeExpiry {
+            delete(resumable, id)
+        }
+    }
+
+    if record, ok := resumable[previousID]; ok && record.ClientKey == clientKey {
+        record.LastSeen = time.Now()
+        return previousID, true
+    }
+
+    id := newSessionID()
+    resumable[id] = &resumeRecord{
+        ClientKey: clientKey,
+        Partials:  make(map[string]*partialFile),
+        LastSeen:  time.Now(),
+    }
+    return id, false
+}
+
+func forgetResumable(sessionID string) {
+    resumeMu.Lock()
+    defer resumeMu.Unlock()
+    delete(resumable, sessionID)
+}
+
+func lookupPartial(sessionID, relPath string) *partialFile {
+    resumeMu.Lock()
+    defer resumeMu.Unlock()
+
+    record, ok := resumable[sessionID]
+    if !ok || record.Partials[relPath] == nil {
+        return nil
+    }
+    p := *record.Partials[relPath]
+    return &p
 }
 
-const (
-    PORT = ":8080"
-    BASE_DIR = "received_files"
-)
+// setPartial records (or with p == nil, clears) the partial state of a file.
+func setPartial(sessionID, relPath string, p *partialFile) {
+    resumeMu.Lock()
+    defer resumeMu.Unlock()
 
-func main() {
-    if len(os.Args) < 2 {
-        fmt.Println("Usage: ./server <pattern1> <pattern2> ...")
+    record, ok := resumable[sessionID]
+    if !ok {
         return
     }
-
-    patterns := os.Args[1:]
-    
-    // Create base directory
-    if err := os.MkdirAll(BASE_DIR, 0755); err != nil {
-        fmt.Printf("Error creating base directory: %v\n", err)
+    if p == nil {
+        delete(record.Partials, relPath)
         return
     }
+    record.Partials[relPath] = p
+    record.LastSeen = time.Now()
+}
 
-    // Start TCP server
-    listener, err := net.Listen("tcp", PORT)
+// resumeOffset tells the client how much of a file the server already holds
+// from an earlier connection of the same session.
+func resumeOffset(session *Session, query protocol.ResumeQuery) protocol.ResumeOffset {
+    reply := protocol.ResumeOffset{RelativePath: query.RelativePath}
+
+    p := lookupPartial(session.ID, query.RelativePath)
+    if p == nil || p.Size != query.Size || p.Offset <= 0 {
+        return reply
+    }
+
+    f, err := os.Open(p.FullPath + ".part")
     if err != nil {
-        fmt.Printf("Error starting server: %v\n", err)
-        return
+        return reply
     }
-    defer listener.Close()
+    defer f.Close()
 
-    fmt.Printf("Server listening on %s\nAccepted patterns: %v\n", PORT, patterns)
+    h := sha256.New()
+    if _, err := io.CopyN(h, f, p.Offset); err != nil {
+        return reply
+    }
+    reply.Offset = p.Offset
+    reply.PrefixSHA256 = hex.EncodeToString(h.Sum(nil))
+    return reply
+}
 
-    var wg sync.WaitGroup
-    for {
-        conn, err := listener.Accept()
-        if err != nil {
-            fmt.Printf("Error accepting connection: %v\n", err)
-            continue
-        }
+func hashFile(path string) (string, int64, error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return "", 0, err
+    }
+    defer f.Close()
 
-        wg.Add(1)
-        go handleClient(conn, patterns, &wg)
+    h := sha256.New()
+    n, err := io.Copy(h, f)
+    if err != nil {
+        return "", 0, err
     }
+    return hex.EncodeToString(h.Sum(nil)), n, nil
 }
 
-func handleClient(conn net.Conn, patterns []string, wg *sync.WaitGroup) {
-    defer conn.Close()
-    defer wg.Done()
-
-    clientAddr := conn.RemoteAddr().String()
-    fmt.Printf("New connection from: %s\n", clientAddr)
+// writeReceipt appends one verified file to the receipts log, the server's
+// record of what each client submitted and when. The original modification
+// time and mode are recorded as the client reported them.
+func writeReceipt(session *Session, header protocol.FileHeader, fullPath string, size int64, sum string) {
+    receiptsMu.Lock()
+    defer receiptsMu.Unlock()
 
-    // Send patterns to client
-    encoder := json.NewEncoder(conn)
-    if err := encoder.Encode(patterns); err != nil {
-        fmt.Printf("Error sending patterns to client %s: %v\n", clientAddr, err)
+    f, err := os.OpenFile(filepath.Join(BASE_DIR, RECEIPTS_FILE), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+    if err != nil {
+        fmt.Printf("Error writing receipt: %v\n", err)
         return
     }
+    defer f.Close()
 
-    // Receive files
-    decoder := json.NewDecoder(conn)
-    for {
-        var fileInfo FileInfo
-        err := decoder.Decode(&fileInfo)
-        if err == io.EOF {
-            break
+    fmt.Fprintf(f, "%s session=%s host=%q ip=%s size=%d sha256=%s path=%q",
+        time.Now().Format("2006-01-02 15:04:05"), session.ID, session.Hostname, session.ClientIP, size, sum, fullPath)
+    if !header.ModTime.IsZero() {
+        fmt.Fprintf(f, " mtime=%s mode=%s", header.ModTime.Local().Format("2006-01-02 15:04:05"), header.Mode)
+    }
+    fmt.Fprintln(f)
+}
+
+// acceptSession reads the client's magic and Hello and answers with a
+// Welcome. Version mismatches are reported to the client before returning.
+func acceptSession(conn net.Conn, reader *bufio.Reader, writer *bufio.Writer, config Config, refused string) (*Session, error) {
+    conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+    defer conn.SetReadDeadline(time.Time{})
+
+    magic := make([]byte, len(protocol.Magic))
+    if _, err := io.ReadFull(reader, magic); err != nil {
+        if ne, ok := err.(net.Error); ok && ne.Timeout() {
+            return nil, fmt.Errorf("no hello within %v (client from before the handshake?)", handshakeTimeout)
+        }
+        return nil, fmt.Errorf("error reading hello: %v", err)
+    }
+    if string(magic) != protocol.Magic {
+        return nil, fmt.Errorf("not a LAB-GO client (got %q)", magic)
+    }
+
+    var hello protocol.Hello
+    if err := protocol.ReadJSONFrame(reader, protocol.FrameHello, &hello); err != nil {
+        return nil, fmt.Errorf("error reading hello: %v", err)
+    }
+
+    welcome := protocol.Welcome{
+        ProtocolVersion: protocol.Version,
+        ServerVersion:   serverVersion,
+    }
+    if hello.ProtocolVersion != protocol.Version {
+        welcome.Error = fmt.Sprintf("protocol version mismatch: server speaks %d, client speaks %d",
+            protocol.Version, hello.ProtocolVersion)
+        protocol.WriteJSONFrame(writer, protocol.FrameWelcome, welcome)
+        writer.Flush()
+        return nil, fmt.Errorf("%s (host %s, agent %s)", welcome.Error, hello.Hostname, hello.AgentVersion)
+    }
+    if refused != "" {
+        logRejected(conn.RemoteAddr().String(), hello, refused)
+        welcome.Error = refused
+        protocol.WriteJSONFrame(writer, protocol.FrameWelcome, welcome)
+        writer.Flush()
+        return nil, fmt.Errorf("refused: %s", refused)
+    }
+
+    // The folders of a client are named after the address it connects from
+    // and, once authenticated, the hostname it was enrolled with; what the
+    // client claims in Hello only goes into the logs
+    remoteIP, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+    hostname := hello.Hostname
+
+    // Nothing about the session is revealed before the client is authenticated
+    if !config.NoAuth {
+        var err error
+        if hello.PairingCode != "" {
+            welcome.EnrolledKey, err = enrollClient(config.RegistryFile, hello)
+            if err == nil {
+                fmt.Printf("Enrolled machine %s (%s)\n", hello.MachineID, hello.Hostname)
+            }
+        } else {
+            hostname, err = authenticate(reader, writer, hello, config.RegistryFile)
         }
         if err != nil {
-            fmt.Printf("Error receiving file from %s: %v\n", clientAddr, err)
-            return
+            logRejected(conn.RemoteAddr().String(), hello, err.Error())
+            welcome.Error = "authentication failed: " + err.Error()
+            welcome.EnrolledKey = ""
+            protocol.WriteJSONFrame(writer, protocol.FrameWelcome, welcome)
+            writer.Flush()
+            return nil, fmt.Errorf("authentication failed: %v", err)
         }
+    }
 
-        if err := saveFile(fileInfo); err != nil {
-            fmt.Printf("Error saving file from %s: %v\n", clientAddr, err)
-            continue
+    if hostname != hello.Hostname || remoteIP != hello.ClientIP {
+        fmt.Printf("Machine %s claims to be %s (%s), filed as %s (%s)\n", hello.MachineID, hello.Hostname, hello.ClientIP, hostname, remoteIP)
+    }
+
+    session := &Session{
+        MachineID:    hello.MachineID,
+        Hostname:     hostname,
+        ClientIP:     remoteIP,
+        AgentVersion: hello.AgentVersion,
+        Started:      time.Now(),
+        Stored:       make(map[string]string),
+        Counted:      make(map[string]int64),
+    }
+    for _, feature := range serverFeatures {
+        if protocol.HasFeature(hello.Capabilities, feature) {
+            session.Features = append(session.Features, feature)
+        }
+    }
+
+    previousID := ""
+    if protocol.HasFeature(session.Features, protocol.CapResume) {
+        previousID = hello.ResumeSessionID
+    }
+    clientKey := hello.MachineID
+    if clientKey == "" {
+        clientKey = hostname + "|" + remoteIP
+    }
+    session.ClientKey = clientKey
+    session.ID, session.Resumed = openResumable(previousID, clientKey)
+
+    welcome.SessionID = session.ID
+    welcome.Resumed = session.Resumed
+    welcome.Features = session.Features
+    for _, name := range hello.Codecs {
+        if protocol.HasFeature(config.Codecs, name) {
+            welcome.Codec = name
+            break
         }
+    }
+    welcome.Patterns = config.Patterns
+    welcome.Limits = config.Limits
+    if protocol.HasFeature(session.Features, protocol.CapDistribution) && len(distribution.Files) > 0 {
+        welcome.Distribution = &distribution
+    }
+    if protocol.HasFeature(session.Features, protocol.CapServerPolicy) {
+        welcome.Policy = config.Policy
+    }
+    if err := protocol.WriteJSONFrame(writer, protocol.FrameWelcome, welcome); err != nil {
+        return nil, fmt.Errorf("error sending welcome: %v", err)
+    }
+    if err := writer.Flush(); err != nil {
+        return nil, fmt.Errorf("error sending welcome: %v", err)
+    }
+    return session, nil
+}
 
-        fmt.Printf("Received file from %s: %s\n", clientAddr, fileInfo.RelativePath)
+func newSessionID() string {
+    b := make([]byte, 8)
+    if _, err := rand.Read(b); err != nil {
+        return fmt.Sprintf("%x", time.Now().UnixNano())
     }
+    return hex.EncodeToString(b)
 }
-func saveFile(fileInfo FileInfo) error {
-    // Get current timestamp
-    timestamp := time.Now().Format("2006_01_02___15_04")
-    
+
+// clientDirName names a client's folders after its hostname and IP address,
+// as verified by the server and not as claimed in Hello.
+func clientDirName(session *Session) string {
     // Sanitize IP address and username
-    sanitizedIP := strings.ReplaceAll(fileInfo.ClientIP, ".", "_")
-    sanitizedUsername := strings.ReplaceAll(fileInfo.Username, " ", "_")
-    
-    // Create base client directory name
-    clientDirName := fmt.Sprintf("%s_%s_%s", sanitizedUsername, sanitizedIP, timestamp)
-    
-    // Clean and sanitize relative path
-    cleanRelPath := filepath.Clean(fileInfo.RelativePath)
-    cleanRelPath = strings.ReplaceAll(cleanRelPath, "/", string(os.PathSeparator))
-    
+    sanitizedIP := strings.ReplaceAll(session.ClientIP, ".", "_")
+    sanitizedUsername := strings.NewReplacer(" ", "_", "/", "_", "\\", "_").Replace(session.Hostname)
+    return fmt.Sprintf("%s_%s", sanitizedUsername, sanitizedIP)
+}
+
+// slashPath gives a relative path sent by a client forward slashes. Clients
+// on Windows send their own separator, and the server keys, compares and
+// exports paths in one form whatever OS it runs on.
+func slashPath(relPath string) string {
+    return strings.ReplaceAll(relPath, "\\", "/")
+}
+
+// localPath turns a relative path sent by a client into one for this OS.
+func localPath(relPath string) string {
+    cleanRelPath := filepath.Clean(slashPath(relPath))
+    return strings.ReplaceAll(cleanRelPath, "/", string(os.PathSeparator))
+}
+
+// sessionFolder returns the submission folder of a session, creating it
+// with its submission record on the first call. A resumed session goes on
+// in the folder of the connection it continues, so a dropped connection
+// does not split a submission either.
+func sessionFolder(session *Session) (string, error) {
+    if session.Folder != "" {
+        return session.Folder, nil
+    }
+
+    resumeMu.Lock()
+    record := resumable[session.ID]
+    folder := ""
+    if record != nil {
+        folder = record.Folder
+    }
+    if folder == "" {
+        folder = filepath.Join(BASE_DIR, clientDirName(session)+"_"+session.Started.Format("2006_01_02___15_04_05"))
+        if record != nil {
+            record.Folder = folder
+        }
+    }
+    resumeMu.Unlock()
+
+    if err := os.MkdirAll(folder, 0755); err != nil {
+        return "", fmt.Errorf("error creating submission folder: %v", err)
+    }
+    session.Folder = folder
+    writeSubmissionRecord(session, time.Time{})
+    return folder, nil
+}
+
+// savedFile is what saveFile stored: the blob, or the folder for a folder
+// entry, with the SHA-256 and size of the content as it landed on disk.
+type savedFile struct {
+    Path   string
+    SHA256 string
+    Size   int64
+}
+
+func saveFile(session *Session, header protocol.FileHeader, data io.Reader) (savedFile, error) {
+    folder, err := sessionFolder(session)
+    if err != nil {
+        return savedFile{}, err
+    }
+
     // Create full path
-    fullPath := filepath.Join(BASE_DIR, clientDirName, cleanRelPath)
+    fullPath := filepath.Join(folder, localPath(header.RelativePath))
     
     // Security check
     absBasedir, _ := filepath.Abs(BASE_DIR)
     absPath, _ := filepath.Abs(fullPath)
     if !strings.HasPrefix(absPath, absBasedir) {
-        return fmt.Errorf("invalid path: attempted to write outside base directory")
+        return savedFile{}, fmt.Errorf("invalid path: attempted to write outside base directory")
     }
     
     // Create all parent directories
     dirPath := filepath.Dir(fullPath)
     if err := os.MkdirAll(dirPath, 0755); err != nil {
-        return fmt.Errorf("error creating directory structure: %v", err)
+        return savedFile{}, fmt.Errorf("error creating directory structure: %v", err)
     }
 
     // If this is just a directory entry (no content)
-    if fileInfo.Content == nil {
-        return nil
+    if header.IsDir {
+        return savedFile{Path: fullPath}, os.MkdirAll(fullPath, 0755)
+    }
+
+    // Stream file content to disk. The data goes to a .part file first so a
+    // dropped connection never leaves a truncated file under its real name.
+    var f *os.File
+    if header.Offset > 0 {
+        p := lookupPartial(session.ID, header.RelativePath)
+        if p == nil || p.Offset != header.Offset {
+            return savedFile{}, fmt.Errorf("cannot resume at offset %d: no matching partial file", header.Offset)
+        }
+        fullPath = p.FullPath
+        f, err = os.OpenFile(fullPath+".part", os.O_WRONLY, 0644)
+        if err == nil {
+            if err = f.Truncate(header.Offset); err == nil {
+                _, err = f.Seek(header.Offset, io.SeekStart)
+            }
+            if err != nil {
+                f.Close()
+            }
+        }
+    } else {
+        f, err = os.Create(fullPath + ".part")
+    }
+    if err != nil {
+        return savedFile{}, fmt.Errorf("error writing file: %v", err)
+    }
+
+    setPartial(session.ID, header.RelativePath, &partialFile{FullPath: fullPath, Size: header.Size, Offset: header.Offset})
+    n, err := io.Copy(f, data)
+    if err != nil {
+        f.Close()
+        setPartial(session.ID, header.RelativePath, &partialFile{FullPath: fullPath, Size: header.Size, Offset: header.Offset + n})
+        return savedFile{}, fmt.Errorf("error writing file: %v", err)
+    }
+    if err := f.Close(); err != nil {
+        return savedFile{}, fmt.Errorf("error writing file: %v", err)
+    }
+    setPartial(session.ID, header.RelativePath, nil)
+
+    // The content goes to the blob store; the submission folder only gets
+    // its tree entry, with the student's edit time, once it is verified
+    saved, err := storeBlob(fullPath + ".part")
+    if err != nil {
+        return savedFile{}, fmt.Errorf("error storing file: %v", err)
+    }
+
+    fmt.Printf("Successfully saved %s to: %s\n", header.RelativePath, saved.Path)
+    return saved, nil
+}
+
+// blobPath is where content with the given SHA-256 is stored.
+func blobPath(sum string) string {
+    return filepath.Join(BASE_DIR, BLOBS_DIR, sum[:2], sum)
+}
+
+// storeBlob moves a finished file into the blob store, named by its SHA-256,
+// and returns the blob with the hash and size. Content that is stored already
+// is kept once: the new copy is dropped and the blob's time refreshed, so gc
+// does not take it before the new tree entry refers to it. Blobs are
+// read-only; the student's edit time is kept in the tree and applied to
+// copies only.
+func storeBlob(src string) (savedFile, error) {
+    sum, size, err := hashFile(src)
+    if err != nil {
+        return savedFile{}, err
+    }
+    saved := savedFile{Path: blobPath(sum), SHA256: sum, Size: size}
+    if _, err := os.Stat(saved.Path); err == nil {
+        now := time.Now()
+        os.Chtimes(saved.Path, now, now)
+        return saved, os.Remove(src)
+    }
+    if err := os.MkdirAll(filepath.Dir(saved.Path), 0755); err != nil {
+        return savedFile{}, err
+    }
+    if err := os.Chmod(src, 0444); err != nil {
+        return savedFile{}, err
+    }
+    return saved, os.Rename(src, saved.Path)
+}
+
+
+// sniffedConn hands out the bytes sniffClient already buffered before
+// reading further from the connection.
+type sniffedConn struct {
+    net.Conn
+    r *bufio.Reader
+}
+
+func (c *sniffedConn) Read(p []byte) (int, error) {
+    return c.r.Read(p)
+}
+
+// sniffClient looks at how a connection starts: a TLS handshake, the
+// protocol magic of a plaintext client, or one of the legacy generations.
+// It returns the connection to use and, for a legacy client, its generation.
+// Plaintext current clients are refused while TLS is enabled and legacy
+// clients unless config.Legacy is set.
+func sniffClient(conn net.Conn, config Config, tlsConfig *tls.Config) (net.Conn, string, error) {
+    wait := handshakeTimeout
+    if config.Legacy {
+        wait = legacyWait
+    }
+    conn.SetReadDeadline(time.Now().Add(wait))
+    defer conn.SetReadDeadline(time.Time{})
+
+    reader := bufio.NewReader(conn)
+    sniffed := &sniffedConn{Conn: conn, r: reader}
+    first, err := reader.Peek(1)
+    if ne, ok := err.(net.Error); ok && ne.Timeout() {
+        if config.Legacy {
+            return sniffed, legacyGen5, nil
+        }
+        return nil, "", fmt.Errorf("no hello within %v (client from before the handshake? see --legacy)", handshakeTimeout)
+    }
+    if err != nil {
+        return nil, "", fmt.Errorf("error reading hello: %v", err)
+    }
+
+    if first[0] == tlsHandshakeRecord {
+        if tlsConfig == nil {
+            return nil, "", fmt.Errorf("TLS client, but the server runs with --no-tls")
+        }
+        return tls.Server(sniffed, tlsConfig), "", nil
+    }
+
+    // A client that wrote less than the magic before closing is not a
+    // current one, so the short read is not an error here
+    magic, _ := reader.Peek(len(protocol.Magic))
+    if string(magic) == protocol.Magic {
+        if tlsConfig != nil {
+            return nil, "", fmt.Errorf("plaintext client, but the server requires TLS (start it with --no-tls or give the client the certificate)")
+        }
+        return sniffed, "", nil
+    }
+    if !config.Legacy {
+        return nil, "", fmt.Errorf("not a LAB-GO client (got %q), older clients are accepted with --legacy", magic)
+    }
+
+    line, err := peekLine(reader)
+    if err != nil {
+        return nil, "", fmt.Errorf("error reading legacy header: %v", err)
+    }
+    switch strings.Count(line, "|") {
+    case 0:
+        return sniffed, legacyGen3, nil
+    case 1:
+        return sniffed, legacyGen1, nil
+    case 3:
+        return sniffed, legacyGen4, nil
+    }
+    return nil, "", fmt.Errorf("unknown legacy header %q", strings.TrimSpace(line))
+}
+
+// peekLine returns the first line in reader, newline included, without
+// consuming it. Lines longer than the reader's buffer are an error.
+func peekLine(reader *bufio.Reader) (string, error) {
+    for {
+        b, _ := reader.Peek(reader.Buffered())
+        if i := bytes.IndexByte(b, '\n'); i >= 0 {
+            return string(b[:i+1]), nil
+        }
+        if _, err := reader.Peek(len(b) + 1); err != nil {
+            return "", err
+        }
+    }
+}
+
+// handleLegacyClient receives the files of a legacy client into the same
+// layout and logs as current clients. Legacy clients get no acks or
+// rejections, so problems only show up in the server output and logs.
+func handleLegacyClient(conn net.Conn, generation string, config Config) {
+    clientAddr := conn.RemoteAddr().String()
+    remoteIP, _, _ := net.SplitHostPort(clientAddr)
+
+    // Legacy streams have no boundary between waiting for the next file and
+    // receiving one, so the more generous idle timeout applies throughout
+    dc := &protocol.DeadlineConn{Conn: conn, ReadTimeout: config.IdleTimeout, WriteTimeout: config.WriteTimeout}
+    reader := bufio.NewReader(dc)
+
+    var session *Session
+    if generation == legacyGen1 || generation == legacyGen4 {
+        var leave func()
+        session, leave = joinLegacyRun(remoteIP, generation)
+        defer leave()
+    } else {
+        session = newLegacySession(remoteIP, generation)
+        defer closeSubmission(session)
+    }
+    fmt.Printf("Session %s: %s client from %s\n", session.ID, generation, clientAddr)
+
+    var err error
+    switch generation {
+    case legacyGen1:
+        err = receiveGen1(session, reader, config.Limits)
+    case legacyGen3:
+        err = receiveGen3(session, reader, config.Limits)
+    case legacyGen4:
+        err = receiveGen4(session, reader, config.Limits)
+    case legacyGen5:
+        err = receiveGen5(session, reader, bufio.NewWriter(dc), config)
+    }
+
+    reason := "session finished"
+    if limitErr, ok := err.(*limitError); ok {
+        reason = "rejected: " + limitErr.reason
+        logRejected(clientAddr, protocol.Hello{Hostname: session.Hostname, ClientIP: session.ClientIP, AgentVersion: generation}, limitErr.reason)
+    } else if err != nil {
+        reason = disconnectReason(err, config.IdleTimeout)
+        fmt.Printf("Error receiving file from %s: %v\n", clientAddr, err)
+    }
+    fmt.Printf("Client %s disconnected: %s, %d files stored\n", clientAddr, reason, len(session.Stored))
+    writeEvent(session, "disconnected", "", reason)
+}
+
+// newLegacySession starts the session of a legacy client. Generations that
+// send a hostname fill it in from the stream.
+func newLegacySession(remoteIP, generation string) *Session {
+    return &Session{
+        ID:           newSessionID(),
+        Hostname:     "unknown",
+        ClientIP:     remoteIP,
+        AgentVersion: generation,
+        Started:      time.Now(),
+        Stored:       make(map[string]string),
+        Counted:      make(map[string]int64),
+    }
+}
+
+// legacyRun is the session shared by the one-file connections of a
+// generation 1 or 4 client, so a submission is one folder and one snapshot
+// and not one per file. mu keeps the connections, which generation 4 opens
+// in parallel, from using the session at the same time.
+type legacyRun struct {
+    mu      sync.Mutex
+    session *Session
+    conns   int       // connections of the run still open
+    ended   time.Time // when the last one ended
+}
+
+var (
+    legacyRunsMu sync.Mutex
+    legacyRuns   = make(map[string]*legacyRun)
+)
+
+// joinLegacyRun returns the session of a one-file connection from remoteIP
+// and the function to call when the connection is done with it.
+func joinLegacyRun(remoteIP, generation string) (*Session, func()) {
+    key := generation + "|" + remoteIP
+    legacyRunsMu.Lock()
+    run := legacyRuns[key]
+    if run == nil {
+        run = &legacyRun{session: newLegacySession(remoteIP, generation)}
+        legacyRuns[key] = run
+    }
+    run.conns++
+    legacyRunsMu.Unlock()
+
+    run.mu.Lock()
+    return run.session, func() {
+        run.mu.Unlock()
+
+        legacyRunsMu.Lock()
+        defer legacyRunsMu.Unlock()
+        run.conns--
+        run.ended = time.Now()
+        if run.conns == 0 {
+            time.AfterFunc(legacyRunGap, func() { closeLegacyRun(key, run) })
+        }
+    }
+}
+
+// closeLegacyRun closes the session of a run no connection joined for
+// legacyRunGap. Timers of earlier connections find it still in use and
+// leave it alone.
+func closeLegacyRun(key string, run *legacyRun) {
+    legacyRunsMu.Lock()
+    if legacyRuns[key] != run || run.conns > 0 || time.Since(run.ended) < legacyRunGap {
+        legacyRunsMu.Unlock()
+        return
+    }
+    delete(legacyRuns, key)
+    legacyRunsMu.Unlock()
+
+    fmt.Printf("Session %s of %s client %s ended: %d files stored\n", run.session.ID, run.session.AgentVersion, run.session.ClientIP, len(run.session.Stored))
+    closeSubmission(run.session)
+}
+
+// receiveLegacyFile stores one file of a legacy stream that announced its
+// size. A stream that ends before size bytes is broken; a file refused for
+// its name is skipped so the next one still lines up.
+func receiveLegacyFile(session *Session, reader io.Reader, relPath string, size int64, limits protocol.Limits) error {
+    header := protocol.FileHeader{RelativePath: legacyPath(relPath), Size: size}
+    data := &sizedReader{r: reader, n: size}
+    ack, err := receivePlain(session, header, data, limits)
+    if err != nil {
+        return err
+    }
+    if _, err := io.Copy(io.Discard, data); err != nil {
+        return err
+    }
+    logLegacyAck(session, ack)
+    return nil
+}
+
+// sizedReader reads the n bytes a legacy header announced. Unlike
+// io.LimitReader it fails when the stream ends early, so saveFile never
+// stores a cut-off file under its real name.
+type sizedReader struct {
+    r io.Reader
+    n int64
+}
+
+func (s *sizedReader) Read(p []byte) (int, error) {
+    if s.n <= 0 {
+        return 0, io.EOF
+    }
+    if int64(len(p)) > s.n {
+        p = p[:s.n]
+    }
+    n, err := s.r.Read(p)
+    s.n -= int64(n)
+    if err == io.EOF && s.n > 0 {
+        err = io.ErrUnexpectedEOF
+    }
+    return n, err
+}
+
+func logLegacyAck(session *Session, ack protocol.FileAck) {
+    if ack.OK {
+        fmt.Printf("Received file from %s (%s): %s\n", session.ClientIP, session.AgentVersion, ack.RelativePath)
+    } else {
+        fmt.Printf("Error saving file from %s (%s): %s: %s\n", session.ClientIP, session.AgentVersion, ack.RelativePath, ack.Error)
+    }
+}
+
+// legacyPath turns the file name a legacy client sent, with Windows
+// separators on some lab images, into a relative path.
+func legacyPath(name string) string {
+    return strings.TrimPrefix(path.Clean("/"+slashPath(name)), "/")
+}
+
+// receiveGen1 reads the single "name|size" file of a 1/main.go connection.
+func receiveGen1(session *Session, reader *bufio.Reader, limits protocol.Limits) error {
+    line, err := reader.ReadString('\n')
+    if err != nil {
+        return err
     }
+    parts := strings.Split(strings.TrimSpace(line), "|")
+    size, err := strconv.ParseInt(parts[1], 10, 64)
+    if err != nil || size < 0 {
+        return fmt.Errorf("invalid size in header %q", strings.TrimSpace(line))
+    }
+    return receiveLegacyFile(session, reader, parts[0], size, limits)
+}
+
+// receiveGen3 reads the hostname and then "name\nsize\n" and the content of
+// every file 3/client.go sends over its single connection.
+func receiveGen3(session *Session, reader *bufio.Reader, limits protocol.Limits) error {
+    hostname, err := reader.ReadString('\n')
+    if err != nil {
+        return err
+    }
+    session.Hostname = strings.TrimSpace(hostname)
+    fmt.Printf("Legacy client %s is %s\n", session.ClientIP, session.Hostname)
+
+    for {
+        name, err := reader.ReadString('\n')
+        if err == io.EOF && name == "" {
+            return nil
+        }
+        if err != nil {
+            return err
+        }
+        sizeLine, err := reader.ReadString('\n')
+        if err != nil {
+            return err
+        }
+        size, err := strconv.ParseInt(strings.TrimSpace(sizeLine), 10, 64)
+        if err != nil || size < 0 {
+            return fmt.Errorf("invalid size %q for %s", strings.TrimSpace(sizeLine), strings.TrimSpace(name))
+        }
+        if err := receiveLegacyFile(session, reader, strings.TrimSpace(name), size, limits); err != nil {
+            return err
+        }
+    }
+}
 
-    // Write file
-    if err := os.WriteFile(fullPath, fileInfo.Content, 0644); err != nil {
-        return fmt.Errorf("error writing file: %v", err)
+// receiveGen4 reads the single file of a "4 failed/client.go" connection. The
+// header carries the client's own IP and hostname; the content has no size
+// and runs until the client closes the connection.
+func receiveGen4(session *Session, reader *bufio.Reader, limits protocol.Limits) error {
+    line, err := reader.ReadString('\n')
+    if err != nil {
+        return err
+    }
+    parts := strings.Split(strings.TrimSpace(line), "|")
+    session.Hostname = parts[1]
+    if parts[0] != session.ClientIP {
+        fmt.Printf("Legacy client %s claims to be %s\n", session.ClientIP, parts[0])
     }
 
-    fmt.Printf("Successfully saved file to: %s\n", fullPath)
+    ack, err := receivePlain(session, protocol.FileHeader{RelativePath: legacyPath(parts[2])}, reader, limits)
+    if err != nil {
+        return err
+    }
+    logLegacyAck(session, ack)
     return nil
+}
+
+// legacyFileInfo is what the generation 5 client sends for every file and
+// folder. Folders have no Content.
+type legacyFileInfo struct {
+    RelativePath string
+    Content      []byte
+    ClientIP     string
+    Username     string
+}
+
+// receiveGen5 sends the patterns the generation 5 client waits for and
+// decodes the FileInfo objects it answers with.
+func receiveGen5(session *Session, reader *bufio.Reader, writer *bufio.Writer, config Config) error {
+    if err := json.NewEncoder(writer).Encode(config.Patterns); err != nil {
+        return err
+    }
+    if err := writer.Flush(); err != nil {
+        return err
+    }
+
+    // Whole files are decoded into memory, so the limits have to hold on the
+    // JSON stream already: the session limit over the whole stream and the
+    // file size limit over every object. Base64 inflates the content by a third
+    limits := config.Limits
+    var stream io.Reader = reader
+    if limits.MaxSessionBytes > 0 {
+        reason := fmt.Sprintf("more than %d bytes in one session", limits.MaxSessionBytes)
+        stream = &limitReader{r: stream, n: limits.MaxSessionBytes/3*4 + 1<<20, reason: reason}
+    }
+    var object *limitReader
+    budget := limits.MaxFileSize/3*4 + 1<<20
+    if limits.MaxFileSize > 0 {
+        object = &limitReader{r: stream, reason: fmt.Sprintf("a file larger than %d bytes", limits.MaxFileSize)}
+        stream = object
+    }
+
+    decoder := json.NewDecoder(stream)
+    var read, given int64 // bytes the decoder took from stream, the last budget set
+    for first := true; ; first = false {
+        if object != nil {
+            // The decoder reads ahead, so what it buffered past the last
+            // object is the start of this one and counts against its budget
+            read += given - object.n
+            object.n = budget - (read - decoder.InputOffset())
+            given = object.n
+        }
+        start := decoder.InputOffset()
+        var info legacyFileInfo
+        err := decoder.Decode(&info)
+        if err == io.EOF {
+            return nil
+        }
+        if err != nil {
+            return err
+        }
+        // A read past the budget that also completes the object is not
+        // reported by Decode, so its size is checked once it is decoded
+        if object != nil && decoder.InputOffset()-start > budget {
+            return &limitError{reason: object.reason}
+        }
+        // The client names itself in every object, the folder is named after
+        // the first and the address it connects from
+        if first {
+            session.Hostname = info.Username
+            if info.ClientIP != session.ClientIP {
+                fmt.Printf("Legacy client %s claims to be %s\n", session.ClientIP, info.ClientIP)
+            }
+        }
+
+        relPath := legacyPath(info.RelativePath)
+        if info.Content == nil {
+            header := protocol.FileHeader{RelativePath: relPath, IsDir: true}
+            if err := header.Validate(); err != nil {
+                fmt.Printf("Error saving folder from %s (%s): %v\n", session.ClientIP, session.AgentVersion, err)
+                continue
+            }
+            if _, err := saveFile(session, header, nil); err != nil {
+                fmt.Printf("Error saving folder from %s (%s): %v\n", session.ClientIP, session.AgentVersion, err)
+                continue
+            }
+            recordTree(session, header, "", 0)
+            continue
+        }
+
+        header := protocol.FileHeader{RelativePath: relPath, Size: int64(len(info.Content))}
+        ack, err := receivePlain(session, header, bytes.NewReader(info.Content), config.Limits)
+        if err != nil {
+            return err
+        }
+        logLegacyAck(session, ack)
+    }
 }
\ No newline at end of file
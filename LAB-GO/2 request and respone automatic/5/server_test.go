@@ -0,0 +1,349 @@
+package main
+
+import (
+    "archive/zip"
+    "crypto/sha256"
+    "crypto/tls"
+    "encoding/hex"
+    "encoding/json"
+    "net"
+    "os"
+    "path/filepath"
+    "reflect"
+    "strings"
+    "testing"
+    "time"
+
+    "labgo/protocol"
+)
+
+var modTime = time.Date(2024, 6, 10, 10, 47, 0, 0, time.UTC)
+
+func newTestSession() *Session {
+    return &Session{
+        ID:        "abc",
+        ClientKey: "2af7",
+        Stored:    make(map[string]string),
+        Counted:   make(map[string]int64),
+    }
+}
+
+// writeTestFile creates a file under dir and returns its path and SHA-256.
+func writeTestFile(t *testing.T, dir, name, content string) (string, string) {
+    t.Helper()
+    fullPath := filepath.Join(dir, filepath.FromSlash(name))
+    if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+        t.Fatal(err)
+    }
+    if err := os.WriteFile(fullPath, []byte(content), 0644); err != nil {
+        t.Fatal(err)
+    }
+    sum := sha256.Sum256([]byte(content))
+    return fullPath, hex.EncodeToString(sum[:])
+}
+
+func TestCheckLimits(t *testing.T) {
+    limits := protocol.Limits{MaxFileSize: 100, MaxFiles: 2, MaxSessionBytes: 150}
+    type step struct {
+        header   protocol.FileHeader
+        received int64 // content bytes that arrive, counted the way receiveFile does
+        allowed  int64
+        refused  bool
+    }
+    cases := []struct {
+        name  string
+        steps []step
+        files int
+        bytes int64
+    }{
+        {"within limits", []step{
+            {protocol.FileHeader{RelativePath: "UAS/a.c", Size: 40}, 40, 100, false},
+            {protocol.FileHeader{RelativePath: "UAS/b.c", Size: 60}, 60, 100, false},
+        }, 2, 100},
+        {"too many files", []step{
+            {protocol.FileHeader{RelativePath: "UAS/a.c", Size: 1}, 1, 100, false},
+            {protocol.FileHeader{RelativePath: "UAS/b.c", Size: 1}, 1, 100, false},
+            {protocol.FileHeader{RelativePath: "UAS/c.c", Size: 1}, 0, 0, true},
+        }, 3, 2},
+        {"file too large", []step{
+            {protocol.FileHeader{RelativePath: "UAS/a.c", Size: 101}, 0, 0, true},
+        }, 1, 0},
+        {"session bytes used up", []step{
+            {protocol.FileHeader{RelativePath: "UAS/a.c", Size: 90}, 90, 100, false},
+            {protocol.FileHeader{RelativePath: "UAS/b.c", Size: 70}, 0, 0, true},
+        }, 2, 90},
+        {"sent again after a nack counts once", []step{
+            {protocol.FileHeader{RelativePath: "UAS/a.c", Size: 90}, 90, 100, false},
+            {protocol.FileHeader{RelativePath: "UAS/a.c", Size: 90}, 90, 100, false},
+            {protocol.FileHeader{RelativePath: "UAS/b.c", Size: 50}, 50, 60, false},
+        }, 2, 140},
+        {"resumed at an offset", []step{
+            {protocol.FileHeader{RelativePath: "UAS/a.c", Size: 90}, 40, 100, false},
+            {protocol.FileHeader{RelativePath: "UAS/a.c", Size: 90, Offset: 40}, 50, 60, false},
+        }, 1, 90},
+        {"folders are not counted", []step{
+            {protocol.FileHeader{RelativePath: "UAS", IsDir: true}, 0, -1, false},
+            {protocol.FileHeader{RelativePath: "UAS/sub", IsDir: true}, 0, -1, false},
+            {protocol.FileHeader{RelativePath: "UAS/tmp", IsDir: true}, 0, -1, false},
+        }, 0, 0},
+    }
+    for _, c := range cases {
+        session := newTestSession()
+        for i, s := range c.steps {
+            allowed, _, err := checkLimits(session, s.header, limits)
+            if _, ok := err.(*limitError); ok != s.refused || err != nil && !ok {
+                t.Errorf("%s: step %d: error %v, want refused %v", c.name, i, err, s.refused)
+                continue
+            }
+            if err != nil {
+                continue
+            }
+            if allowed != s.allowed {
+                t.Errorf("%s: step %d: allowed %d, want %d", c.name, i, allowed, s.allowed)
+            }
+            session.BytesReceived += s.received
+            session.Counted[s.header.RelativePath] += s.received
+        }
+        if session.Files != c.files || session.BytesReceived != c.bytes {
+            t.Errorf("%s: counted %d files and %d bytes, want %d and %d", c.name, session.Files, session.BytesReceived, c.files, c.bytes)
+        }
+    }
+}
+
+func TestWantedFilesAndMissingHeld(t *testing.T) {
+    dir := t.TempDir()
+    same, sameSum := writeTestFile(t, dir, "same.c", "abc")
+    touched, touchedSum := writeTestFile(t, dir, "touched.c", "def")
+    changed, _ := writeTestFile(t, dir, "changed.c", "ghi")
+    _, goneSum := writeTestFile(t, dir, "unused.c", "jkl")
+
+    held = map[string]map[string]heldFile{
+        "2af7": {
+            "UAS":            {IsDir: true, FullPath: dir},
+            "UAS/same.c":     {Size: 3, ModTime: modTime, SHA256: sameSum, FullPath: same},
+            "UAS/touched.c":  {Size: 3, ModTime: modTime, SHA256: touchedSum, FullPath: touched},
+            "UAS/changed.c":  {Size: 3, ModTime: modTime, SHA256: "0000", FullPath: changed},
+            "UAS/gone.c":     {Size: 3, ModTime: modTime, SHA256: goneSum, FullPath: filepath.Join(dir, "gone.c")},
+            "UAS/unhashed.c": {Size: 3, ModTime: modTime, FullPath: same},
+            "UAS/deleted.c":  {Size: 3, ModTime: modTime, SHA256: sameSum, FullPath: same},
+            "UAS/old":        {IsDir: true, FullPath: dir},
+            "UAS/old/main.c": {Size: 3, ModTime: modTime, SHA256: sameSum, FullPath: same},
+        },
+        "other": {
+            "UAS/mine.c": {Size: 3, ModTime: modTime, SHA256: sameSum, FullPath: same},
+        },
+    }
+    defer func() { held = make(map[string]map[string]heldFile) }()
+
+    session := newTestSession()
+    session.Listing = []protocol.ListingEntry{
+        {RelativePath: "UAS", IsDir: true},
+        {RelativePath: "UAS/same.c", Size: 3, ModTime: modTime, SHA256: sameSum},
+        {RelativePath: "UAS/touched.c", Size: 3, ModTime: modTime.Add(time.Minute), SHA256: touchedSum},
+        {RelativePath: "UAS/changed.c", Size: 3, ModTime: modTime, SHA256: sameSum},
+        {RelativePath: "UAS/gone.c", Size: 3, ModTime: modTime, SHA256: goneSum},
+        {RelativePath: "UAS/new.c", Size: 3, ModTime: modTime, SHA256: sameSum},
+        {RelativePath: "UAS/unhashed.c", Size: 3, ModTime: modTime},
+    }
+
+    wanted := wantedFiles(session)
+    if want := []int{2, 3, 4, 5, 6}; !reflect.DeepEqual(wanted.Indexes, want) {
+        t.Errorf("wanted %v, want %v", wanted.Indexes, want)
+    }
+    if want := map[string]string{"UAS": dir, "UAS/same.c": same}; !reflect.DeepEqual(session.Stored, want) {
+        t.Errorf("skipped files stored as %v, want %v", session.Stored, want)
+    }
+
+    // Held copies outlive the session, so a client listing after a restart
+    // of either side still has its deletions found
+    restarted := newTestSession()
+    restarted.Listing = session.Listing
+    for _, s := range []*Session{session, restarted} {
+        if missing, want := missingHeld(s), []string{"UAS/old/main.c", "UAS/old", "UAS/deleted.c"}; !reflect.DeepEqual(missing, want) {
+            t.Errorf("missing held %v, want %v", missing, want)
+        }
+    }
+}
+
+func TestReconcile(t *testing.T) {
+    dir := t.TempDir()
+    mainPath, mainSum := writeTestFile(t, dir, "main.c", "int main() {}")
+    util, utilSum := writeTestFile(t, dir, "util.c", "int util;")
+    changed, _ := writeTestFile(t, dir, "changed.c", "changed on disk")
+    stored := map[string]string{
+        "UAS":            dir,
+        "UAS/main.c":     mainPath,
+        "UAS/util.c":     util,
+        "UAS/changed.c":  changed,
+        "UAS/vanished.c": filepath.Join(dir, "vanished.c"),
+    }
+    mainEntry := protocol.ManifestEntry{RelativePath: "UAS/main.c", Size: 13, SHA256: mainSum}
+    utilEntry := protocol.ManifestEntry{RelativePath: "UAS/util.c", Size: 9, SHA256: utilSum}
+
+    cases := []struct {
+        name     string
+        manifest []protocol.ManifestEntry
+        files    int // ManifestEnd.Files
+        status   string
+        missing  []string
+        corrupt  []string
+    }{
+        {"complete", []protocol.ManifestEntry{{RelativePath: "UAS", IsDir: true}, mainEntry, utilEntry}, 3,
+            protocol.StatusComplete, nil, nil},
+        {"file never stored", []protocol.ManifestEntry{mainEntry, {RelativePath: "UAS/lost.c", Size: 1, SHA256: "ab"}}, 2,
+            protocol.StatusIncomplete, []string{"UAS/lost.c"}, nil},
+        {"folder never stored", []protocol.ManifestEntry{{RelativePath: "UAS/empty", IsDir: true}}, 1,
+            protocol.StatusIncomplete, []string{"UAS/empty"}, nil},
+        {"stored copy gone from disk", []protocol.ManifestEntry{{RelativePath: "UAS/vanished.c", Size: 1, SHA256: "ab"}}, 1,
+            protocol.StatusIncomplete, []string{"UAS/vanished.c"}, nil},
+        {"manifest entries lost", []protocol.ManifestEntry{mainEntry}, 2,
+            protocol.StatusIncomplete, nil, nil},
+        {"stored copy differs", []protocol.ManifestEntry{mainEntry, {RelativePath: "UAS/changed.c", Size: 15, SHA256: utilSum}}, 2,
+            protocol.StatusCorrupt, nil, []string{"UAS/changed.c"}},
+        {"corrupt outranks missing", []protocol.ManifestEntry{{RelativePath: "UAS/lost.c"}, {RelativePath: "UAS/util.c", Size: 10, SHA256: utilSum}}, 2,
+            protocol.StatusCorrupt, []string{"UAS/lost.c"}, []string{"UAS/util.c"}},
+    }
+    for _, c := range cases {
+        session := newTestSession()
+        session.Stored = stored
+        session.Manifest = c.manifest
+        status, err := reconcile(session, protocol.ManifestEnd{Files: c.files})
+        if err != nil {
+            t.Errorf("%s: %v", c.name, err)
+            continue
+        }
+        if status.Status != c.status || status.Files != len(c.manifest) ||
+            !reflect.DeepEqual(status.Missing, c.missing) || !reflect.DeepEqual(status.Corrupt, c.corrupt) {
+            t.Errorf("%s: got %+v, want %s with missing %v and corrupt %v", c.name, status, c.status, c.missing, c.corrupt)
+        }
+    }
+}
+
+func TestSniffClient(t *testing.T) {
+    tlsConfig := &tls.Config{}
+    cases := []struct {
+        name       string
+        sent       string
+        legacy     bool
+        tls        bool
+        generation string
+        fails      bool
+    }{
+        {"TLS client", "\x16\x03\x01\x00\x05hello", false, true, "", false},
+        {"TLS client to --no-tls", "\x16\x03\x01\x00\x05hello", false, false, "", true},
+        {"plaintext client to --no-tls", protocol.Magic + "{}", false, false, "", false},
+        {"plaintext client to TLS", protocol.Magic + "{}", false, true, "", true},
+        {"generation 1", "main.c|5\nhello", true, true, legacyGen1, false},
+        {"generation 3", "lab01\nmain.c\n5\nhello", true, true, legacyGen3, false},
+        {"generation 4", "10.0.0.5|lab01|UAS\\main.c|C:\\Users\\lab\\UAS\\main.c\nhello", true, false, legacyGen4, false},
+        {"generation 5 waits for the patterns", "", true, true, legacyGen5, false},
+        {"legacy client without --legacy", "main.c|5\nhello", false, true, "", true},
+        {"unknown legacy header", "a|b|c\n", true, true, "", true},
+    }
+    for _, c := range cases {
+        server, client := net.Pipe()
+        go func(sent string) {
+            if sent != "" {
+                client.Write([]byte(sent))
+            }
+            // Generation 5 stays silent until the server writes
+            time.Sleep(legacyWait + time.Second)
+            client.Close()
+        }(c.sent)
+
+        var serverTLS *tls.Config
+        if c.tls {
+            serverTLS = tlsConfig
+        }
+        conn, generation, err := sniffClient(server, Config{Legacy: c.legacy}, serverTLS)
+        server.Close()
+        if (err != nil) != c.fails {
+            t.Errorf("%s: error %v, want failure %v", c.name, err, c.fails)
+            continue
+        }
+        if err != nil {
+            continue
+        }
+        if generation != c.generation {
+            t.Errorf("%s: generation %q, want %q", c.name, generation, c.generation)
+        }
+        if _, isTLS := conn.(*tls.Conn); isTLS != (c.tls && c.generation == "") {
+            t.Errorf("%s: TLS connection %v, want %v", c.name, isTLS, c.tls && c.generation == "")
+        }
+    }
+}
+
+func TestKelasFolder(t *testing.T) {
+    cases := []struct {
+        files []SnapshotFile
+        class string
+    }{
+        {[]SnapshotFile{{RelativePath: "UAS_2024_KelasA/main.c"}}, "UAS_2024_KelasA"},
+        {[]SnapshotFile{{RelativePath: "UAS_2024_KelasA\\main.c"}}, "UAS_2024_KelasA"},
+        {[]SnapshotFile{{RelativePath: "Struktur Data\\kelas-b\\tugas\\main.c"}}, "kelas-b"},
+        {[]SnapshotFile{{RelativePath: "UAS_KelasC", IsDir: true}}, "UAS_KelasC"},
+        {[]SnapshotFile{{RelativePath: "UAS/kelasA.c"}}, ""},
+        {[]SnapshotFile{{RelativePath: "UAS\\kelasA.c"}}, ""},
+        {nil, ""},
+    }
+    for _, c := range cases {
+        if class := kelasFolder(Snapshot{Files: c.files}); class != c.class {
+            t.Errorf("%v: class %q, want %q", c.files, class, c.class)
+        }
+    }
+}
+
+// TestExportBackslashPaths exports a history recorded from a Windows client
+// and checks the class, the session selection and the names in the zip.
+func TestExportBackslashPaths(t *testing.T) {
+    wd, err := os.Getwd()
+    if err != nil {
+        t.Fatal(err)
+    }
+    dir := t.TempDir()
+    if err := os.Chdir(dir); err != nil {
+        t.Fatal(err)
+    }
+    defer os.Chdir(wd)
+
+    content := "int main() {}"
+    sum := sha256.Sum256([]byte(content))
+    blob := hex.EncodeToString(sum[:])
+    writeTestFile(t, BASE_DIR, BLOBS_DIR+"/"+blob[:2]+"/"+blob, content)
+    snapshots := []Snapshot{
+        {ID: "2024_06_10___10_47_00_abc", SessionName: "UAS_SD", Hostname: "lab01", ClientIP: "10.0.0.5", Created: modTime, Status: protocol.StatusComplete,
+            Files: []SnapshotFile{
+                {RelativePath: "UAS_2024_KelasA", IsDir: true},
+                {RelativePath: "UAS_2024_KelasA\\src\\main.c", Path: BLOBS_DIR + "/" + blob[:2] + "/" + blob},
+            }},
+        {ID: "2024_06_17___10_47_00_def", SessionName: "UAS_BD", Hostname: "lab01", ClientIP: "10.0.0.5", Created: modTime.AddDate(0, 0, 7)},
+    }
+    for _, snapshot := range snapshots {
+        data, err := json.Marshal(snapshot)
+        if err != nil {
+            t.Fatal(err)
+        }
+        writeTestFile(t, BASE_DIR, HISTORY_DIR+"/lab01_10_0_0_5/"+snapshot.ID+".json", string(data))
+    }
+
+    if err := exportCommand([]string{"--out", "export", "--session", "UAS_SD"}); err != nil {
+        t.Fatal(err)
+    }
+    zr, err := zip.OpenReader(filepath.Join("export", "UAS_2024_KelasA.zip"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer zr.Close()
+    var names []string
+    for _, f := range zr.File {
+        names = append(names, f.Name)
+    }
+    if want := []string{"manifest.json", "lab01_10_0_0_5/UAS_2024_KelasA/src/main.c"}; !reflect.DeepEqual(names, want) {
+        t.Errorf("archive holds %v, want %v", names, want)
+    }
+
+    err = exportCommand([]string{"--out", "export", "--session", "UAS_XX"})
+    if err == nil || !strings.Contains(err.Error(), "UAS_XX") {
+        t.Errorf("export of an unknown session: %v", err)
+    }
+}
\ No newline at end of file